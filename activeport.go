@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// activePort is the port qbittorrent listens on, as written to the active port files.
+type activePort struct {
+	// Port is the port of the first target that synced.
+	Port int `json:"port"`
+	// Ports are the ports forwarded by the port source, before translation.
+	Ports  []int  `json:"forwarded_ports"`
+	Source string `json:"source,omitempty"`
+	// Targets maps the targets that synced to their port.
+	Targets map[string]int `json:"targets"`
+}
+
+// ActivePortSpec is a file the active port is written to, from the
+// active_port section of the config file.
+type ActivePortSpec struct {
+	File string `yaml:"file" toml:"file"`
+	// Format is plain, json or dotenv; plain if empty.
+	Format string `yaml:"format" toml:"format"`
+}
+
+// activePortFiles returns the files to write the active port to:
+// --activeportfile and the files of the config file.
+func (c Config) activePortFiles() []ActivePortSpec {
+	if c.ActivePortFile == "" {
+		return c.ActivePortFiles
+	}
+	return append([]ActivePortSpec{{File: c.ActivePortFile, Format: c.ActivePortFormat}}, c.ActivePortFiles...)
+}
+
+// check reports problems with an active port file of the config file.
+func (s ActivePortSpec) check() error {
+	var errs []error
+	if s.File == "" {
+		errs = append(errs, errors.New("needs a file"))
+	}
+	if _, ok := activePortFormats[s.format()]; !ok {
+		errs = append(errs, fmt.Errorf("format %q must be plain, json or dotenv", s.Format))
+	}
+	return errors.Join(errs...)
+}
+
+// format returns the format of the file, plain if none is set.
+func (s ActivePortSpec) format() string {
+	if s.Format == "" {
+		return "plain"
+	}
+	return s.Format
+}
+
+// activePortFormats formats the active port for every --activeportformat.
+var activePortFormats = map[string]func(activePort) ([]byte, error){
+	"plain": func(p activePort) ([]byte, error) {
+		return []byte(fmt.Sprintf("%d\n", p.Port)), nil
+	},
+	"json": func(p activePort) ([]byte, error) {
+		b, err := json.MarshalIndent(p, "", "  ")
+		return append(b, '\n'), err
+	},
+	"dotenv": func(p activePort) ([]byte, error) {
+		var b bytes.Buffer
+		fmt.Fprintf(&b, "GLUEBIT_PORT=%d\n", p.Port)
+		fmt.Fprintf(&b, "GLUEBIT_FORWARDED_PORTS=%s\n", joinPorts(p.Ports))
+		fmt.Fprintf(&b, "GLUEBIT_SOURCE=%s\n", p.Source)
+		names := make([]string, 0, len(p.Targets))
+		for name := range p.Targets {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		fmt.Fprintf(&b, "GLUEBIT_TARGETS=%s\n", strings.Join(names, ","))
+		return b.Bytes(), nil
+	},
+}
+
+// checkActivePortFormat reports whether format is a known --activeportformat.
+func checkActivePortFormat(format string) error {
+	if _, ok := activePortFormats[format]; !ok {
+		return fmt.Errorf("--activeportformat %q must be plain, json or dotenv", format)
+	}
+	return nil
+}
+
+// newActivePort returns the active port of the results of an update, and
+// false if no target synced.
+func newActivePort(results []syncResult, ports []int, source string) (activePort, bool) {
+	p := activePort{Ports: ports, Source: source, Targets: make(map[string]int)}
+	if p.Ports == nil {
+		p.Ports = []int{}
+	}
+	for _, r := range results {
+		if r.err != nil {
+			continue
+		}
+		if len(p.Targets) == 0 {
+			p.Port = r.port
+		}
+		p.Targets[r.target] = r.port
+	}
+	return p, len(p.Targets) > 0
+}
+
+// writeActivePort writes the port of the targets that synced to every
+// active port file, see activePortFiles. A sync is verified if the target was
+// set to the port, or was read to listen on it already.
+func writeActivePort(config Config, results []syncResult, ports []int, source string) {
+	files := config.activePortFiles()
+	if len(files) == 0 {
+		return
+	}
+	p, ok := newActivePort(results, ports, source)
+	if !ok {
+		return
+	}
+	for _, file := range files {
+		writeActivePortFile(file, p)
+	}
+}
+
+// writeActivePortFile writes p to a file in its format, unless the file
+// already has that content. Failures are only logged, and the file is
+// written again on the next update.
+func writeActivePortFile(file ActivePortSpec, p activePort) {
+	format, ok := activePortFormats[file.format()]
+	if !ok {
+		format = activePortFormats["plain"]
+	}
+	b, err := format(p)
+	if err == nil {
+		if current, readErr := os.ReadFile(file.File); readErr == nil && bytes.Equal(current, b) {
+			return
+		}
+		err = writeFileAtomic(file.File, b, 0o644)
+	}
+	if err != nil {
+		logger("activeport").Warn("Failed to write the active port", "path", file.File, "error", err)
+		return
+	}
+	logger("activeport").Info("Wrote the active port", "path", file.File, "port", p.Port)
+}
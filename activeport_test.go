@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWriteActivePort(t *testing.T) {
+	t.Parallel()
+
+	results := []syncResult{
+		{target: "seedbox", err: errors.New("connection refused")},
+		{target: "qbittorrent", port: 52000},
+		{target: "mirror", port: 52001},
+	}
+	tests := []struct {
+		format string
+		want   string
+	}{
+		{format: "plain", want: "52000\n"},
+		{format: "json", want: `{
+  "port": 52000,
+  "forwarded_ports": [
+    51999
+  ],
+  "source": "gluetun-api",
+  "targets": {
+    "mirror": 52001,
+    "qbittorrent": 52000
+  }
+}
+`},
+		{format: "dotenv", want: "GLUEBIT_PORT=52000\nGLUEBIT_FORWARDED_PORTS=51999\nGLUEBIT_SOURCE=gluetun-api\nGLUEBIT_TARGETS=mirror,qbittorrent\n"},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.format, func(t *testing.T) {
+			t.Parallel()
+			path := filepath.Join(t.TempDir(), "port")
+			config := Config{ActivePortFile: path, ActivePortFormat: tt.format}
+			writeActivePort(config, results, []int{51999}, "gluetun-api")
+			b, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != tt.want {
+				t.Errorf("Expected %q, got %q", tt.want, b)
+			}
+		})
+	}
+}
+
+func TestWriteActivePortFiles(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	config := Config{
+		ActivePortFile:   filepath.Join(dir, "port"),
+		ActivePortFormat: "plain",
+		ActivePortFiles:  []ActivePortSpec{{File: filepath.Join(dir, "port.env"), Format: "dotenv"}},
+	}
+	writeActivePort(config, []syncResult{{target: "qbittorrent", port: 52000}}, []int{52000}, "gluetun-api")
+	want := map[string]string{
+		"port":     "52000\n",
+		"port.env": "GLUEBIT_PORT=52000\nGLUEBIT_FORWARDED_PORTS=52000\nGLUEBIT_SOURCE=gluetun-api\nGLUEBIT_TARGETS=qbittorrent\n",
+	}
+	for name, w := range want {
+		b, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != w {
+			t.Errorf("Expected %s to be %q, got %q", name, w, b)
+		}
+	}
+}
+
+func TestWriteActivePortNoSync(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "port")
+	config := Config{ActivePortFile: path, ActivePortFormat: "plain"}
+	writeActivePort(config, []syncResult{{target: "qbittorrent", err: ErrNoPort}}, nil, "")
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("Expected no file without a synced target, got %v", err)
+	}
+
+	tracker := newEventTracker(State{})
+	config.DryRun = true
+	tracker.observe(config, []syncResult{{target: "qbittorrent", port: 52000}}, []int{52000}, []int{52000}, "", time.Time{})
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("Expected no file in a dry run, got %v", err)
+	}
+}
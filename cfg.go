@@ -1,7 +1,14 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
 
 	"github.com/alexflint/go-arg"
 )
@@ -11,16 +18,167 @@ const Description = "set listening port in qbittorrent based on gluetun connecti
 
 // Config represents the configuration options for the gluebit program.
 // It is used by "github.com/alexflint/go-arg" to parse command-line arguments
-// and environment variables.
+// and environment variables. Values from the optional config file are loaded
+// first and can be overridden by environment variables and arguments.
 type Config struct {
-	QbitUsername    string `arg:"--qbituser,env:QBITUSER" default:"" help:"qbittorrent username"`
-	QbitPassword    string `arg:"--qbitpass,env:QBITPASS" default:"" help:"qbittorrent password"`
-	QbitHost        string `arg:"--qbithost,env:QBITHOST" default:"localhost" help:"host to reach qbittorrent on. If this is run on the same docker network as gluetun, this can be set to the container name"`
-	QbitPort        int    `arg:"--qbitport,env:QBITPORT" default:"8080" help:"port to reach qbittorrent on"`
-	GlueTunHost     string `arg:"--gluetunhost,env:GLUETUNHOST" default:"localhost" help:"host to reach gluetun on. If this is run on the same docker network as gluetun, this can be set to the container name"`
-	GlueTunPort     int    `arg:"--gluetunport,env:GLUETUNPORT" default:"8000" help:"port to reach gluetun on"`
-	GlueTunPortFile string `arg:"--gluetunportfile,env:GLUETUNPORTFILE" default:"" help:"path to gluetun port file"`
-	UpdateInterval  int    `arg:"--interval,env:GLUEBIT_INTERVAL" default:"" help:"Update interval in seconds"`
+	ConfigFile       string   `arg:"--config,env:GLUEBIT_CONFIG" default:"" help:"path to a YAML or TOML config file"`
+	WatchConfig      bool     `arg:"--watchconfig,env:GLUEBIT_WATCH_CONFIG" default:"false" help:"reload the config file when it changes. The config is always reloaded on SIGHUP"`
+	QbitUsername     string   `arg:"--qbituser,env:QBITUSER" default:"" help:"qbittorrent username"`
+	QbitPassword     string   `arg:"--qbitpass,env:QBITPASS" default:"" help:"qbittorrent password"`
+	QbitUserFile     string   `arg:"--qbituserfile,env:QBITUSER_FILE" default:"" help:"file to read the qbittorrent username from, e.g. a docker secret"`
+	QbitPassFile     string   `arg:"--qbitpassfile,env:QBITPASS_FILE" default:"" help:"file to read the qbittorrent password from, e.g. a docker secret"`
+	QbitUrl          string   `arg:"--qbiturl,env:QBITURL" default:"" help:"full url to reach qbittorrent on, e.g. https://example.com/qbittorrent/. Takes precedence over --qbithost and --qbitport"`
+	QbitHost         string   `arg:"--qbithost,env:QBITHOST" default:"localhost" help:"host to reach qbittorrent on. If this is run on the same docker network as gluetun, this can be set to the container name"`
+	QbitPort         int      `arg:"--qbitport,env:QBITPORT" default:"8080" help:"port to reach qbittorrent on"`
+	QbitPortIndex    int      `arg:"--qbitportindex,env:QBITPORTINDEX" default:"0" help:"index of the forwarded port to set in qbittorrent when several ports are forwarded, starting at 0"`
+	QbitPortOffset   int      `arg:"--qbitportoffset,env:QBITPORTOFFSET" default:"0" help:"add this offset to the forwarded port before setting it in qbittorrent"`
+	QbitListenPort   int      `arg:"--qbitlistenport,env:QBITLISTENPORT" default:"0" help:"fixed port for qbittorrent to listen on, whatever port is forwarded, e.g. when the forwarded port is redirected with DNAT"`
+	QbitCAFile       string   `arg:"--qbitcafile,env:QBITCAFILE" default:"" help:"PEM file with additional CA certificates to verify qbittorrent's https certificate"`
+	QbitCertFile     string   `arg:"--qbitcertfile,env:QBITCERTFILE" default:"" help:"PEM client certificate to authenticate to qbittorrent with"`
+	QbitKeyFile      string   `arg:"--qbitkeyfile,env:QBITKEYFILE" default:"" help:"PEM private key of the qbittorrent client certificate"`
+	QbitTLSMin       string   `arg:"--qbittlsmin,env:QBITTLSMIN" default:"" help:"minimum TLS version to reach qbittorrent with: 1.0, 1.1, 1.2 or 1.3"`
+	QbitInsecure     bool     `arg:"--qbitinsecure,env:QBITINSECURE" default:"false" help:"do not verify qbittorrent's https certificate. Insecure, only use for testing"`
+	GlueTunUrl       string   `arg:"--gluetunurl,env:GLUETUNURL" default:"" help:"full url to reach the gluetun control server on. Takes precedence over --gluetunhost and --gluetunport"`
+	GlueTunHost      string   `arg:"--gluetunhost,env:GLUETUNHOST" default:"localhost" help:"host to reach gluetun on. If this is run on the same docker network as gluetun, this can be set to the container name"`
+	GlueTunPort      int      `arg:"--gluetunport,env:GLUETUNPORT" default:"8000" help:"port to reach gluetun on"`
+	GlueTunCAFile    string   `arg:"--gluetuncafile,env:GLUETUNCAFILE" default:"" help:"PEM file with additional CA certificates to verify gluetun's https certificate"`
+	GlueTunCertFile  string   `arg:"--gluetuncertfile,env:GLUETUNCERTFILE" default:"" help:"PEM client certificate to authenticate to gluetun with"`
+	GlueTunKeyFile   string   `arg:"--gluetunkeyfile,env:GLUETUNKEYFILE" default:"" help:"PEM private key of the gluetun client certificate"`
+	GlueTunTLSMin    string   `arg:"--gluetuntlsmin,env:GLUETUNTLSMIN" default:"" help:"minimum TLS version to reach gluetun with: 1.0, 1.1, 1.2 or 1.3"`
+	GlueTunInsecure  bool     `arg:"--gluetuninsecure,env:GLUETUNINSECURE" default:"false" help:"do not verify gluetun's https certificate. Insecure, only use for testing"`
+	GlueTunPortFile  string   `arg:"--gluetunportfile,env:GLUETUNPORTFILE" default:"" help:"path to gluetun port file"`
+	NatPmpGateway    string   `arg:"--natpmpgateway,env:NATPMP_GATEWAY" default:"" help:"request the forwarded port from this NAT-PMP gateway instead of gluetun, e.g. 10.2.0.1 for ProtonVPN"`
+	NatPmpLifetime   int      `arg:"--natpmplifetime,env:NATPMP_LIFETIME" default:"60" help:"lifetime in seconds of NAT-PMP port mappings. Mappings are renewed at half their lifetime"`
+	PiaGateway       string   `arg:"--piagateway,env:PIA_GATEWAY" default:"" help:"request the forwarded port from this Private Internet Access gateway instead of gluetun"`
+	PiaHostname      string   `arg:"--piahostname,env:PIA_HOSTNAME" default:"" help:"hostname of the PIA server, used to verify its certificate"`
+	PiaToken         string   `arg:"--piatoken,env:PIA_TOKEN" default:"" help:"PIA authentication token"`
+	PiaTokenFile     string   `arg:"--piatokenfile,env:PIA_TOKEN_FILE" default:"" help:"file to read the PIA authentication token from, e.g. a docker secret"`
+	PiaCAFile        string   `arg:"--piacafile,env:PIA_CAFILE" default:"" help:"PIA's CA certificate, ca.rsa.4096.crt"`
+	StaticPort       int      `arg:"--port,env:GLUEBIT_PORT" default:"0" help:"fixed forwarded port to keep set in qbittorrent, for providers such as AirVPN"`
+	ExecCommand      string   `arg:"--execcommand,env:GLUEBIT_EXEC_COMMAND" default:"" help:"command that prints the forwarded port, split on whitespace. Exiting with a non-zero status is a failure"`
+	ExecField        string   `arg:"--execfield,env:GLUEBIT_EXEC_FIELD" default:"" help:"if set, the output of --execcommand is JSON and the port is read from this field, e.g. data.port"`
+	Sources          string   `arg:"--sources,env:GLUEBIT_SOURCES" default:"" help:"comma separated port sources to try in order, each optionally followed by :timeout, e.g. gluetun-api:2s,gluetun-file. Sources are gluetun-api, gluetun-file, natpmp, pia, exec and static. By default the configured sources are used"`
+	MinPort          int      `arg:"--minport,env:GLUEBIT_MIN_PORT" default:"1024" help:"lowest port to set in qbittorrent. Other ports are ignored and the current port is kept"`
+	MaxPort          int      `arg:"--maxport,env:GLUEBIT_MAX_PORT" default:"65535" help:"highest port to set in qbittorrent"`
+	StableReads      int      `arg:"--stablereads,env:GLUEBIT_STABLE_READS" default:"1" help:"number of updates in a row a new port must be read before it is set, to ignore flapping ports"`
+	StableTime       int      `arg:"--stabletime,env:GLUEBIT_STABLE_TIME" default:"0" help:"seconds a new port must be read for before it is set, to ignore flapping ports"`
+	StateDir         string   `arg:"--statedir,env:GLUEBIT_STATE_DIR" default:"" help:"directory to save the last good port and the result of every target in, to remember them across restarts"`
+	KeepLastPort     bool     `arg:"--keeplastport,env:GLUEBIT_KEEP_LAST_PORT" default:"false" help:"keep setting the last good port while no port source has a port, e.g. while gluetun is down"`
+	ActivePortFile   string   `arg:"--activeportfile,env:GLUEBIT_ACTIVE_PORT_FILE" default:"" help:"file to write the port qbittorrent listens on to after every change, for other containers"`
+	ActivePortFormat string   `arg:"--activeportformat,env:GLUEBIT_ACTIVE_PORT_FORMAT" default:"plain" help:"format of --activeportfile: plain, json or dotenv"`
+	HistoryFile      string   `arg:"--historyfile,env:GLUEBIT_HISTORY_FILE" default:"" help:"file to append the observed ports, port changes, failures and recoveries to as JSON lines"`
+	HistoryMaxSize   int      `arg:"--historymaxsize,env:GLUEBIT_HISTORY_MAX_SIZE" default:"10" help:"MiB the history file may grow to before it is rotated, 0 to never rotate it"`
+	HistoryKeep      int      `arg:"--historykeep,env:GLUEBIT_HISTORY_KEEP" default:"3" help:"number of rotated history files to keep"`
+	WebhookUrl       string   `arg:"--webhookurl,env:GLUEBIT_WEBHOOK_URL" default:"" help:"url to post events to as JSON, e.g. when the port changes"`
+	WebhookHeaders   []string `arg:"--webhookheader,separate,env:GLUEBIT_WEBHOOK_HEADERS" help:"header to send with webhooks as \"Name: value\", can be repeated"`
+	WebhookBody      string   `arg:"--webhookbody,env:GLUEBIT_WEBHOOK_BODY" default:"" help:"text/template of the webhook body, the event as JSON by default"`
+	NotifyFailures   int      `arg:"--notifyfailures,env:GLUEBIT_NOTIFY_FAILURES" default:"3" help:"notify when syncing a target failed this many times in a row"`
+	NotifyInterval   int      `arg:"--notifyinterval,env:GLUEBIT_NOTIFY_INTERVAL" default:"300" help:"seconds to wait before sending another sync_failed event of the same target. The newest one is sent when the interval ends"`
+	HookCommand      string   `arg:"--hookcommand,env:GLUEBIT_HOOK_COMMAND" default:"" help:"command to run when the forwarded port changes, split on whitespace. It gets the ports in GLUEBIT_* environment variables and as JSON on stdin"`
+	HookTimeout      int      `arg:"--hooktimeout,env:GLUEBIT_HOOK_TIMEOUT" default:"30" help:"seconds a hook may run before it is killed"`
+	HookConcurrency  int      `arg:"--hookconcurrency,env:GLUEBIT_HOOK_CONCURRENCY" default:"2" help:"most hooks to run at once"`
+	LogLevel         string   `arg:"--log-level,env:GLUEBIT_LOG_LEVEL" default:"info" help:"lowest level to log: debug, info, warn or error"`
+	LogFormat        string   `arg:"--log-format,env:GLUEBIT_LOG_FORMAT" default:"text" help:"format of the logs: text or json"`
+	DryRun           bool     `arg:"--dry-run,env:GLUEBIT_DRY_RUN" default:"false" help:"look up the ports but only log the changes instead of making them"`
+	UpdateInterval   int      `arg:"--interval,env:GLUEBIT_INTERVAL" default:"" help:"Update interval in seconds"`
+
+	// Targets are additional qbittorrent instances, only settable in the config file.
+	Targets []Target `arg:"-"`
+	// ExecArgs and ExecEnv hold the command and its extra environment from the config file.
+	ExecArgs []string          `arg:"-"`
+	ExecEnv  map[string]string `arg:"-"`
+	// SourceList holds the port sources from the config file, used if --sources is not set.
+	SourceList []SourceSpec `arg:"-"`
+	// QbitTLS and GlueTunTLS hold the TLS options from the config file.
+	// They are combined with the TLS arguments by qbitTLS and gluetunTLS.
+	QbitTLS    TLSOptions `arg:"-"`
+	GlueTunTLS TLSOptions `arg:"-"`
+	// QbitTranslate holds the port translation of qbittorrent from the config file.
+	// It is replaced by --qbitportoffset and --qbitlistenport, see qbitTranslate.
+	QbitTranslate PortRule `arg:"-"`
+	// Notifiers holds the notifiers from the config file, see notifiers.
+	Notifiers []NotifierSpec `arg:"-"`
+	// Hooks holds the hooks from the config file, see hooks.
+	Hooks []HookSpec `arg:"-"`
+	// Templates holds the templates from the config file.
+	Templates []TemplateSpec `arg:"-"`
+	// ActivePortFiles holds the active port files from the config file, see
+	// activePortFiles.
+	ActivePortFiles []ActivePortSpec `arg:"-"`
+
+	ConfigCmd      *ConfigCmd  `arg:"subcommand:config" help:"inspect the configuration"`
+	StatusCmd      *StatusCmd  `arg:"subcommand:status" help:"print the last good port and the result of every target"`
+	HistoryCmd     *HistoryCmd `arg:"subcommand:history" help:"print the history of ports, port changes, failures and recoveries"`
+	GluetunPortCmd *struct{}   `arg:"subcommand:gluetun-port" help:"print the ports forwarded by the port sources"`
+	QbitPortCmd    *TargetCmd  `arg:"subcommand:qbit-port" help:"print the port qbittorrent listens on"`
+	SetCmd         *SetCmd     `arg:"subcommand:set" help:"set the port qbittorrent listens on"`
+	SyncCmd        *struct{}   `arg:"subcommand:sync" help:"sync the port once. Exits with 0 if every target is in sync, 2 if no port is forwarded yet, 3 if --dry-run would change the port and 1 on failure"`
+	DoctorCmd      *struct{}   `arg:"subcommand:doctor" help:"check each step from resolving gluetun and qbittorrent to reading the qbittorrent preferences, and print hints for the steps that fail"`
+	DaemonCmd      *struct{}   `arg:"subcommand:daemon" help:"keep the port in sync every --interval seconds. This is the default"`
+}
+
+// ConfigCmd holds the subcommands of "gluebit config".
+type ConfigCmd struct {
+	Validate *struct{} `arg:"subcommand:validate" help:"report all problems in the configuration"`
+}
+
+// StatusCmd holds the options of "gluebit status".
+type StatusCmd struct {
+	JSON bool `arg:"--json" help:"print the state as JSON"`
+}
+
+// Target is a qbittorrent instance that should listen on the forwarded port.
+type Target struct {
+	Name         string     `yaml:"name" toml:"name"`
+	URL          string     `yaml:"url" toml:"url"`
+	Host         string     `yaml:"host" toml:"host"`
+	Port         int        `yaml:"port" toml:"port"`
+	Username     string     `yaml:"username" toml:"username"`
+	Password     string     `yaml:"password" toml:"password"`
+	UsernameFile string     `yaml:"username_file" toml:"username_file"`
+	PasswordFile string     `yaml:"password_file" toml:"password_file"`
+	TLS          TLSOptions `yaml:"tls" toml:"tls"`
+	// PortIndex selects the forwarded port of the target when several are forwarded.
+	PortIndex int `yaml:"port_index" toml:"port_index"`
+	// Translate translates the forwarded port into the port the target listens on.
+	Translate PortRule `yaml:"translate" toml:"translate"`
+}
+
+// url returns the url to reach the target.
+func (t Target) url() string {
+	return hostPortUrl(t.URL, t.Host, t.Port)
+}
+
+// hostPortUrl returns rawUrl if set, or else an http url built from host and port.
+// IPv6 hosts are enclosed in brackets.
+func hostPortUrl(rawUrl string, host string, port int) string {
+	if rawUrl != "" {
+		return rawUrl
+	}
+	return "http://" + net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+// addressWithPort returns address, adding port if it has none.
+func addressWithPort(address string, port int) string {
+	if _, _, err := net.SplitHostPort(address); err == nil {
+		return address
+	}
+	return net.JoinHostPort(address, strconv.Itoa(port))
+}
+
+// checkUrl returns an error if rawUrl is not an absolute http or https url.
+func checkUrl(rawUrl string) error {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("url %q must start with http:// or https://", rawUrl)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("url %q has no host", rawUrl)
+	}
+	return nil
 }
 
 // Description returns a string describing the purpose of the program.
@@ -34,26 +192,325 @@ func (Config) Version() string {
 	return fmt.Sprintf("gluebit %s\n", Version)
 }
 
-// qbitUrl returns the url to reach qbittorrent.
-func (c Config) qbitUrl() string {
-	return fmt.Sprintf("http://%s:%d", c.QbitHost, c.QbitPort)
-}
-
 // gluetunUrl returns the url to reach gluetun.
 func (c Config) gluetunUrl() string {
-	return fmt.Sprintf("http://%s:%d", c.GlueTunHost, c.GlueTunPort)
+	return hostPortUrl(c.GlueTunUrl, c.GlueTunHost, c.GlueTunPort)
+}
+
+// gluetunTLS returns the TLS options to reach gluetun with.
+func (c Config) gluetunTLS() TLSOptions {
+	return mergeTLS(c.GlueTunTLS, c.GlueTunCAFile, c.GlueTunCertFile, c.GlueTunKeyFile, c.GlueTunTLSMin, c.GlueTunInsecure)
+}
+
+// qbitTLS returns the TLS options to reach the primary qbittorrent target with.
+func (c Config) qbitTLS() TLSOptions {
+	return mergeTLS(c.QbitTLS, c.QbitCAFile, c.QbitCertFile, c.QbitKeyFile, c.QbitTLSMin, c.QbitInsecure)
+}
+
+// qbitTranslate returns the port translation of the primary qbittorrent target.
+// The translation arguments replace the one from the config file.
+func (c Config) qbitTranslate() PortRule {
+	if c.QbitPortOffset != 0 || c.QbitListenPort != 0 {
+		return PortRule{Offset: c.QbitPortOffset, Port: c.QbitListenPort}
+	}
+	return c.QbitTranslate
+}
+
+// mergeTLS adds the TLS arguments to the TLS options from the config file.
+// The CA file is trusted in addition to the ones in the file, other arguments replace them.
+func mergeTLS(o TLSOptions, caFile, certFile, keyFile, minVersion string, insecure bool) TLSOptions {
+	if caFile != "" {
+		o.CAFiles = append(append([]string(nil), o.CAFiles...), caFile)
+	}
+	setString(&o.CertFile, certFile)
+	setString(&o.KeyFile, keyFile)
+	setString(&o.MinVersion, minVersion)
+	o.Insecure = o.Insecure || insecure
+	return o
+}
+
+// sources returns the port sources to try, in order.
+// Without --sources or a list in the config file, the sources that have settings
+// are used: a static port, NAT-PMP, PIA or a command if configured, or else the gluetun api then the gluetun file.
+func (c Config) sources() []SourceSpec {
+	if c.Sources != "" {
+		return parseSources(c.Sources)
+	}
+	if len(c.SourceList) > 0 {
+		return c.SourceList
+	}
+	var specs []SourceSpec
+	switch {
+	case c.StaticPort != 0:
+		specs = append(specs, SourceSpec{Type: "static"})
+	case c.NatPmpGateway != "":
+		specs = append(specs, SourceSpec{Type: "natpmp"})
+	case c.PiaGateway != "":
+		specs = append(specs, SourceSpec{Type: "pia"})
+	case len(c.execCommand()) > 0:
+		specs = append(specs, SourceSpec{Type: "exec"})
+	default:
+		if c.gluetunApi() {
+			specs = append(specs, SourceSpec{Type: "gluetun-api"})
+		}
+		if c.GlueTunPortFile != "" {
+			specs = append(specs, SourceSpec{Type: "gluetun-file"})
+		}
+	}
+	return specs
+}
+
+// gluetunApi reports whether the gluetun control server is configured.
+func (c Config) gluetunApi() bool {
+	return c.GlueTunUrl != "" || c.GlueTunPort != 0
+}
+
+// notifiers returns the notifiers to send events to: the webhook of
+// --webhookurl, if set, followed by the notifiers of the config file.
+func (c Config) notifiers() []NotifierSpec {
+	if c.WebhookUrl == "" {
+		return c.Notifiers
+	}
+	webhook := NotifierSpec{Type: "webhook", URL: c.WebhookUrl, Body: c.WebhookBody}
+	for _, h := range c.WebhookHeaders {
+		if name, value, ok := strings.Cut(h, ":"); ok {
+			if webhook.Headers == nil {
+				webhook.Headers = make(map[string]string)
+			}
+			webhook.Headers[strings.TrimSpace(name)] = strings.TrimSpace(value)
+		}
+	}
+	return append([]NotifierSpec{webhook}, c.Notifiers...)
+}
+
+// targets returns every qbittorrent instance to keep in sync,
+// starting with the one configured by --qbithost and --qbitport.
+func (c Config) targets() []Target {
+	primary := Target{
+		Name:      "qbittorrent",
+		URL:       c.QbitUrl,
+		Host:      c.QbitHost,
+		Port:      c.QbitPort,
+		Username:  c.QbitUsername,
+		Password:  c.QbitPassword,
+		TLS:       c.qbitTLS(),
+		PortIndex: c.QbitPortIndex,
+		Translate: c.qbitTranslate(),
+	}
+	return append([]Target{primary}, c.Targets...)
+}
+
+// target returns the target with the given name,
+// or the main qbittorrent instance if name is empty.
+func (c Config) target(name string) (Target, error) {
+	targets := c.targets()
+	if name == "" {
+		return targets[0], nil
+	}
+	for _, t := range targets {
+		if t.Name == name {
+			return t, nil
+		}
+	}
+	return Target{}, fmt.Errorf("unknown target %q", name)
+}
+
+// validate checks the config and returns every problem found, joined into one error.
+func (c Config) validate() error {
+	var errs []error
+	specs := c.sources()
+	if len(specs) == 0 {
+		errs = append(errs, errors.New("no port source: must specify either --gluetunurl, --gluetunhost and --gluetunport, --gluetunportfile, --natpmpgateway, --piagateway, --execcommand, --port or --sources"))
+	}
+	seen := make(map[string]bool)
+	for _, spec := range specs {
+		if seen[spec.Type] {
+			errs = append(errs, fmt.Errorf("source %s is listed more than once", spec.Type))
+			continue
+		}
+		seen[spec.Type] = true
+		if err := spec.check(c); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if r := c.allowedPorts(); r.min < 1 || r.max > 65535 || r.min > r.max {
+		errs = append(errs, fmt.Errorf("--minport %d and --maxport %d are not a valid range of ports", r.min, r.max))
+	}
+	if c.StableReads < 0 {
+		errs = append(errs, fmt.Errorf("--stablereads %d must not be negative", c.StableReads))
+	}
+	if c.StableTime < 0 {
+		errs = append(errs, fmt.Errorf("--stabletime %d must not be negative", c.StableTime))
+	}
+	if c.UpdateInterval == 0 && (c.StableReads > 1 || c.StableTime > 0) {
+		errs = append(errs, errors.New("--stablereads and --stabletime need --interval"))
+	}
+	if c.UpdateInterval < 0 {
+		errs = append(errs, fmt.Errorf("--interval %d must not be negative", c.UpdateInterval))
+	}
+	for _, h := range c.WebhookHeaders {
+		if name, _, ok := strings.Cut(h, ":"); !ok || strings.TrimSpace(name) == "" {
+			errs = append(errs, fmt.Errorf("--webhookheader %q must be \"Name: value\"", h))
+		}
+	}
+	for i, spec := range c.notifiers() {
+		if err := checkNotifier(spec); err != nil {
+			errs = append(errs, fmt.Errorf("notifiers[%d] %s: %w", i, spec.Type, err))
+		}
+	}
+	if len(c.notifiers()) > 0 && c.NotifyFailures < 1 {
+		errs = append(errs, fmt.Errorf("--notifyfailures %d must be at least 1", c.NotifyFailures))
+	}
+	if c.NotifyInterval < 0 {
+		errs = append(errs, fmt.Errorf("--notifyinterval %d must not be negative", c.NotifyInterval))
+	}
+	for i, hook := range c.hooks() {
+		if err := hook.check(); err != nil {
+			errs = append(errs, fmt.Errorf("hooks[%d]: %w", i, err))
+		}
+	}
+	if len(c.hooks()) > 0 && c.HookTimeout < 1 {
+		errs = append(errs, fmt.Errorf("--hooktimeout %d must be at least 1", c.HookTimeout))
+	}
+	if len(c.hooks()) > 0 && c.HookConcurrency < 1 {
+		errs = append(errs, fmt.Errorf("--hookconcurrency %d must be at least 1", c.HookConcurrency))
+	}
+	if err := c.checkLogging(); err != nil {
+		errs = append(errs, err)
+	}
+	if c.HistoryMaxSize < 0 {
+		errs = append(errs, fmt.Errorf("--historymaxsize %d must not be negative", c.HistoryMaxSize))
+	}
+	if c.HistoryKeep < 0 {
+		errs = append(errs, fmt.Errorf("--historykeep %d must not be negative", c.HistoryKeep))
+	}
+	if c.ActivePortFile != "" {
+		if err := checkActivePortFormat(c.ActivePortFormat); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for i, file := range c.ActivePortFiles {
+		if err := file.check(); err != nil {
+			errs = append(errs, fmt.Errorf("active_port.files[%d]: %w", i, err))
+		}
+	}
+	outputs := make(map[string]bool)
+	for _, file := range c.activePortFiles() {
+		if file.File != "" && outputs[file.File] {
+			errs = append(errs, fmt.Errorf("active port file %s is used twice", file.File))
+		}
+		outputs[file.File] = true
+	}
+	for i, tmpl := range c.Templates {
+		if err := tmpl.check(); err != nil {
+			errs = append(errs, fmt.Errorf("templates[%d]: %w", i, err))
+		}
+		if tmpl.Output != "" && outputs[tmpl.Output] {
+			errs = append(errs, fmt.Errorf("templates[%d]: output %s is used twice", i, tmpl.Output))
+		}
+		outputs[tmpl.Output] = true
+	}
+	names := make(map[string]bool)
+	for i, t := range c.targets() {
+		name := t.Name
+		if i == 0 {
+			if t.URL == "" && (t.Host == "" || t.Port == 0) {
+				errs = append(errs, errors.New("need --qbiturl or --qbithost and --qbitport"))
+			}
+		} else {
+			if name == "" {
+				name = fmt.Sprintf("targets[%d]", i-1)
+				errs = append(errs, fmt.Errorf("%s: missing name", name))
+			}
+			if t.URL == "" && (t.Host == "" || t.Port == 0) {
+				errs = append(errs, fmt.Errorf("%s: need url or host and port", name))
+			}
+		}
+		if t.URL != "" {
+			if err := checkUrl(t.URL); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", name, err))
+			}
+		}
+		if _, err := t.TLS.tlsConfig(); err != nil {
+			errs = append(errs, fmt.Errorf("%s TLS: %w", name, err))
+		}
+		if err := t.Translate.check(c.allowedPorts()); err != nil {
+			errs = append(errs, fmt.Errorf("%s translate: %w", name, err))
+		}
+		if t.PortIndex < 0 {
+			errs = append(errs, fmt.Errorf("%s: port index %d must not be negative", name, t.PortIndex))
+		}
+		if t.Port < 0 || t.Port > 65535 {
+			errs = append(errs, fmt.Errorf("%s: port %d is not a valid port", name, t.Port))
+		}
+		if t.Name != "" && names[t.Name] {
+			errs = append(errs, fmt.Errorf("%s: duplicate target name", name))
+		}
+		names[t.Name] = true
+	}
+	return errors.Join(errs...)
 }
 
 // loadConfig returns a Config struct.
-// It loads the configuration from command-line arguments and environment variables.
-func loadConfig() Config {
+// It loads the configuration from the config file, environment variables and
+// command-line arguments, in increasing order of precedence.
+// An invalid config exits the program, unless the subcommand only inspects the
+// config, the state or the history; the problems are then returned.
+func loadConfig() (Config, error) {
+	cli, p, err := parseConfig()
+	if cli.ConfigCmd != nil && cli.ConfigCmd.Validate == nil {
+		p.FailSubcommand("missing subcommand", "config")
+	}
+	if cli.inspects() {
+		return cli, err
+	}
+	if err != nil {
+		p.Fail(fmt.Sprintf("Invalid config:\n%s", err))
+	}
+	setupLogging(cli, os.Stderr)
+	if cli.gluetunTLS().Insecure {
+		logger("config").Warn("TLS certificate verification is disabled for gluetun")
+	}
+	for _, t := range cli.targets() {
+		if t.TLS.Insecure {
+			logger("config").Warn("TLS certificate verification is disabled", "target", t.Name)
+		}
+	}
+	return cli, nil
+}
+
+// inspects reports whether the subcommand only inspects the config, the state
+// or the history, and so also runs with an invalid config.
+func (c Config) inspects() bool {
+	return c.ConfigCmd != nil || c.StatusCmd != nil || c.HistoryCmd != nil
+}
+
+// parseConfig parses the config file, environment variables and command-line
+// arguments into a Config. The returned error joins all problems found.
+func parseConfig() (Config, *arg.Parser, error) {
+	// a first pass finds the config file and handles --help and --version
+	var pre Config
+	arg.MustParse(&pre)
+
+	// non-zero values from the file become the defaults of the second pass,
+	// so environment variables and arguments take precedence over them
 	var cli Config
-	p := arg.MustParse(&cli)
-	if (cli.GlueTunHost == "" || cli.GlueTunPort == 0) && cli.GlueTunPortFile == "" {
-		p.Fail("Invalid config: must specify either --gluetunhost and --gluetunport or --gluetunportfile")
+	var fileErr error
+	if pre.ConfigFile != "" {
+		cli, fileErr = readConfigFile(pre.ConfigFile)
 	}
-	if cli.QbitHost == "" || cli.QbitPort == 0 {
-		p.Fail("Invalid config: need --qbithost and --qbitport")
+	p := arg.MustParse(&cli)
+	secretErr := cli.readSecretFiles()
+	return cli, p, errors.Join(fileErr, secretErr, cli.validate())
+}
+
+// validateConfig implements "gluebit config validate".
+// It prints every problem found in the config and returns the exit code.
+func validateConfig(w io.Writer, problems error) int {
+	if problems != nil {
+		fmt.Fprintf(os.Stderr, "Invalid config:\n%s\n", problems)
+		return 1
 	}
-	return cli
+	fmt.Fprintln(w, "Config is valid")
+	return 0
 }
@@ -2,13 +2,15 @@ package main
 
 import (
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 )
 
 func TestLoadConfig(t *testing.T) {
 	// Test case 1: valid config with --gluetunhost and --gluetunport
 	os.Args = []string{"cmd", "--qbituser", "user", "--qbitpass", "pass", "--qbithost", "localhost", "--qbitport", "8080", "--gluetunhost", "localhost", "--gluetunport", "8000", "--interval", "60"}
-	config := loadConfig()
+	config, _ := loadConfig()
 	if config.QbitUsername != "user" {
 		t.Errorf("Expected QbitUsername to be 'user', but got '%s'", config.QbitUsername)
 	}
@@ -33,7 +35,7 @@ func TestLoadConfig(t *testing.T) {
 
 	// Test case 2: valid config with --gluetunportfile
 	os.Args = []string{"cmd", "--qbituser", "user", "--qbitpass", "pass", "--qbithost", "localhost", "--qbitport", "8080", "--gluetunportfile", "/path/to/portfile"}
-	config = loadConfig()
+	config, _ = loadConfig()
 	if config.QbitUsername != "user" {
 		t.Errorf("Expected QbitUsername to be 'user', but got '%s'", config.QbitUsername)
 	}
@@ -53,3 +55,133 @@ func TestLoadConfig(t *testing.T) {
 		t.Errorf("Expected UpdateInterval to be 0, but got %d", config.UpdateInterval)
 	}
 }
+
+func TestLoadConfigFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gluebit.yaml")
+	err := os.WriteFile(path, []byte("interval: 30\nkeep_last_port: true\nqbittorrent:\n  host: filehost\n  port: 9090\n  username: fileuser\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the file sets defaults, environment variables override them and arguments override both
+	t.Setenv("QBITHOST", "envhost")
+	t.Setenv("QBITUSER", "envuser")
+	os.Args = []string{"cmd", "--config", path, "--qbituser", "arguser"}
+	config, _ := loadConfig()
+	if config.UpdateInterval != 30 {
+		t.Errorf("Expected UpdateInterval to be 30, but got %d", config.UpdateInterval)
+	}
+	if config.QbitPort != 9090 {
+		t.Errorf("Expected QbitPort to be 9090, but got %d", config.QbitPort)
+	}
+	if config.QbitHost != "envhost" {
+		t.Errorf("Expected QbitHost to be 'envhost', but got '%s'", config.QbitHost)
+	}
+	if config.QbitUsername != "arguser" {
+		t.Errorf("Expected QbitUsername to be 'arguser', but got '%s'", config.QbitUsername)
+	}
+	if !config.KeepLastPort {
+		t.Error("Expected KeepLastPort to be true")
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	t.Parallel()
+
+	valid := Config{QbitHost: "localhost", QbitPort: 8080, GlueTunHost: "localhost", GlueTunPort: 8000}
+	if err := valid.validate(); err != nil {
+		t.Errorf("Unexpected error, %s", err)
+	}
+
+	invalid := Config{
+		QbitPort:         8080,
+		MinPort:          2000,
+		MaxPort:          1000,
+		UpdateInterval:   -1,
+		HistoryKeep:      -1,
+		ActivePortFile:   "/shared/port",
+		ActivePortFormat: "yaml",
+		ActivePortFiles:  []ActivePortSpec{{Format: "xml"}, {File: "/shared/port"}},
+		WebhookUrl:       "chat.lan/hook",
+		WebhookHeaders:   []string{"Authorization"},
+		NotifyInterval:   -1,
+		Hooks:            []HookSpec{{Timeout: "soon"}},
+		Targets: []Target{
+			{Name: "a", Host: "a", Port: 70000},
+			{Name: "a", Host: "a", Port: 8080, Translate: PortRule{Port: 80}},
+			{Host: "b", PortIndex: -1},
+		},
+	}
+	err := invalid.validate()
+	if err == nil {
+		t.Fatal("Expected error, got nil")
+	}
+	// every problem is reported, not only the first one
+	want := []string{
+		"no port source: must specify either --gluetunurl, --gluetunhost and --gluetunport, --gluetunportfile, --natpmpgateway, --piagateway, --execcommand, --port or --sources",
+		"--minport 2000 and --maxport 1000 are not a valid range of ports",
+		"--interval -1 must not be negative",
+		`--webhookheader "Authorization" must be "Name: value"`,
+		`notifiers[0] webhook: url "chat.lan/hook" must start with http:// or https://`,
+		"--notifyfailures 0 must be at least 1",
+		"--notifyinterval -1 must not be negative",
+		"hooks[0]: needs a command",
+		`timeout "soon" is not a positive duration`,
+		"--hooktimeout 0 must be at least 1",
+		"--historykeep -1 must not be negative",
+		`--activeportformat "yaml" must be plain, json or dotenv`,
+		"active_port.files[0]: needs a file",
+		`format "xml" must be plain, json or dotenv`,
+		"active port file /shared/port is used twice",
+		"need --qbiturl or --qbithost and --qbitport",
+		"a: port 70000 is not a valid port",
+		"a: duplicate target name",
+		"a translate: invalid port 80: not between 2000 and 1000",
+		"targets[2]: missing name",
+		"targets[2]: need url or host and port",
+		"targets[2]: port index -1 must not be negative",
+	}
+	for _, w := range want {
+		if !strings.Contains(err.Error(), w) {
+			t.Errorf("Expected error to contain %q, got %q", w, err)
+		}
+	}
+}
+
+func TestHostPortUrl(t *testing.T) {
+	t.Parallel()
+
+	tt := []struct {
+		name     string
+		url      string
+		host     string
+		port     int
+		expected string
+	}{
+		{name: "host and port", host: "gluetun", port: 8000, expected: "http://gluetun:8000"},
+		{name: "ipv6 host", host: "fd00::1", port: 8080, expected: "http://[fd00::1]:8080"},
+		{name: "url takes precedence", url: "https://example.com/qbittorrent/", host: "gluetun", port: 8080, expected: "https://example.com/qbittorrent/"},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := hostPortUrl(tc.url, tc.host, tc.port); got != tc.expected {
+				t.Errorf("Expected url '%s', got '%s'", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestCheckUrl(t *testing.T) {
+	t.Parallel()
+
+	for _, valid := range []string{"http://gluetun:8000", "https://example.com/qbittorrent/", "http://[::1]:8080"} {
+		if err := checkUrl(valid); err != nil {
+			t.Errorf("Unexpected error for '%s', %s", valid, err)
+		}
+	}
+	for _, invalid := range []string{"gluetun:8000", "ftp://example.com", "http://", "http://[::1"} {
+		if err := checkUrl(invalid); err == nil {
+			t.Errorf("Expected error for '%s', got nil", invalid)
+		}
+	}
+}
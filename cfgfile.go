@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// fileConfig is the schema of the optional config file.
+// Keys are the same for YAML and TOML files, e.g.
+//
+//	interval: 60
+//	gluetun:
+//	  host: gluetun
+//	  port: 8000
+//	  portfile: /tmp/gluetun/forwarded_port
+//	qbittorrent:
+//	  host: gluetun
+//	  port: 8080
+//	  username: admin
+//	  password: adminadmin
+//	targets:
+//	  - name: seedbox
+//	    url: https://seedbox.lan/qbittorrent/
+//	    username: admin
+//	    password: secret
+type fileConfig struct {
+	Interval     int          `yaml:"interval" toml:"interval"`
+	MinPort      int          `yaml:"min_port" toml:"min_port"`
+	MaxPort      int          `yaml:"max_port" toml:"max_port"`
+	StableReads  int          `yaml:"stable_reads" toml:"stable_reads"`
+	StableTime   int          `yaml:"stable_time" toml:"stable_time"`
+	StateDir     string       `yaml:"state_dir" toml:"state_dir"`
+	KeepLastPort bool         `yaml:"keep_last_port" toml:"keep_last_port"`
+	ActivePort   fileActive   `yaml:"active_port" toml:"active_port"`
+	Log          fileLog      `yaml:"log" toml:"log"`
+	History      fileHistory  `yaml:"history" toml:"history"`
+	DryRun       bool         `yaml:"dry_run" toml:"dry_run"`
+	Gluetun      fileGluetun  `yaml:"gluetun" toml:"gluetun"`
+	NatPmp       fileNatPmp   `yaml:"natpmp" toml:"natpmp"`
+	Pia          filePia      `yaml:"pia" toml:"pia"`
+	Exec         fileExec     `yaml:"exec" toml:"exec"`
+	Static       fileStatic   `yaml:"static" toml:"static"`
+	Qbittorrent  Target       `yaml:"qbittorrent" toml:"qbittorrent"`
+	Targets      []Target     `yaml:"targets" toml:"targets"`
+	Sources      []SourceSpec `yaml:"sources" toml:"sources"`
+	Notify       fileNotify   `yaml:"notify" toml:"notify"`
+	// HookTimeout and HookConcurrency apply to every hook.
+	HookTimeout     int            `yaml:"hook_timeout" toml:"hook_timeout"`
+	HookConcurrency int            `yaml:"hook_concurrency" toml:"hook_concurrency"`
+	Hooks           []HookSpec     `yaml:"hooks" toml:"hooks"`
+	Templates       []TemplateSpec `yaml:"templates" toml:"templates"`
+}
+
+// fileActive holds the active_port section of the config file.
+type fileActive struct {
+	File   string `yaml:"file" toml:"file"`
+	Format string `yaml:"format" toml:"format"`
+	// Files are written in addition to File, each in its own format.
+	Files []ActivePortSpec `yaml:"files" toml:"files"`
+}
+
+// fileLog holds the log section of the config file.
+type fileLog struct {
+	Level  string `yaml:"level" toml:"level"`
+	Format string `yaml:"format" toml:"format"`
+}
+
+// fileHistory holds the history section of the config file.
+type fileHistory struct {
+	File    string `yaml:"file" toml:"file"`
+	MaxSize int    `yaml:"max_size" toml:"max_size"`
+	Keep    int    `yaml:"keep" toml:"keep"`
+}
+
+// fileNotify holds the notify section of the config file.
+type fileNotify struct {
+	Failures  int            `yaml:"failures" toml:"failures"`
+	Interval  int            `yaml:"interval" toml:"interval"`
+	Notifiers []NotifierSpec `yaml:"notifiers" toml:"notifiers"`
+}
+
+// fileGluetun holds the gluetun section of the config file.
+type fileGluetun struct {
+	URL      string     `yaml:"url" toml:"url"`
+	Host     string     `yaml:"host" toml:"host"`
+	Port     int        `yaml:"port" toml:"port"`
+	PortFile string     `yaml:"portfile" toml:"portfile"`
+	TLS      TLSOptions `yaml:"tls" toml:"tls"`
+}
+
+// fileNatPmp holds the natpmp section of the config file.
+type fileNatPmp struct {
+	Gateway  string `yaml:"gateway" toml:"gateway"`
+	Lifetime int    `yaml:"lifetime" toml:"lifetime"`
+}
+
+// filePia holds the pia section of the config file.
+type filePia struct {
+	Gateway   string `yaml:"gateway" toml:"gateway"`
+	Hostname  string `yaml:"hostname" toml:"hostname"`
+	Token     string `yaml:"token" toml:"token"`
+	TokenFile string `yaml:"token_file" toml:"token_file"`
+	CAFile    string `yaml:"ca_file" toml:"ca_file"`
+}
+
+// fileExec holds the exec section of the config file.
+type fileExec struct {
+	Command []string          `yaml:"command" toml:"command"`
+	Field   string            `yaml:"field" toml:"field"`
+	Env     map[string]string `yaml:"env" toml:"env"`
+}
+
+// fileStatic holds the static section of the config file.
+type fileStatic struct {
+	Port int `yaml:"port" toml:"port"`
+}
+
+// apply copies the values of the config file into a Config.
+// Only non-zero values are copied, so that unset keys keep their defaults.
+func (f fileConfig) apply(c *Config) {
+	setString(&c.QbitUsername, f.Qbittorrent.Username)
+	setString(&c.QbitPassword, f.Qbittorrent.Password)
+	setString(&c.QbitUserFile, f.Qbittorrent.UsernameFile)
+	setString(&c.QbitPassFile, f.Qbittorrent.PasswordFile)
+	setString(&c.QbitUrl, f.Qbittorrent.URL)
+	setString(&c.QbitHost, f.Qbittorrent.Host)
+	setInt(&c.QbitPort, f.Qbittorrent.Port)
+	setInt(&c.QbitPortIndex, f.Qbittorrent.PortIndex)
+	setString(&c.GlueTunUrl, f.Gluetun.URL)
+	setString(&c.GlueTunHost, f.Gluetun.Host)
+	setInt(&c.GlueTunPort, f.Gluetun.Port)
+	setString(&c.GlueTunPortFile, f.Gluetun.PortFile)
+	c.QbitTLS = f.Qbittorrent.TLS
+	c.QbitTranslate = f.Qbittorrent.Translate
+	c.GlueTunTLS = f.Gluetun.TLS
+	setString(&c.NatPmpGateway, f.NatPmp.Gateway)
+	setInt(&c.NatPmpLifetime, f.NatPmp.Lifetime)
+	setString(&c.PiaGateway, f.Pia.Gateway)
+	setString(&c.PiaHostname, f.Pia.Hostname)
+	setString(&c.PiaToken, f.Pia.Token)
+	setString(&c.PiaTokenFile, f.Pia.TokenFile)
+	setString(&c.PiaCAFile, f.Pia.CAFile)
+	setString(&c.ExecField, f.Exec.Field)
+	c.ExecArgs = f.Exec.Command
+	c.ExecEnv = f.Exec.Env
+	setInt(&c.StaticPort, f.Static.Port)
+	setInt(&c.UpdateInterval, f.Interval)
+	setInt(&c.MinPort, f.MinPort)
+	setInt(&c.MaxPort, f.MaxPort)
+	setInt(&c.StableReads, f.StableReads)
+	setInt(&c.StableTime, f.StableTime)
+	setString(&c.StateDir, f.StateDir)
+	c.KeepLastPort = c.KeepLastPort || f.KeepLastPort
+	c.DryRun = c.DryRun || f.DryRun
+	setString(&c.LogLevel, f.Log.Level)
+	setString(&c.LogFormat, f.Log.Format)
+	setString(&c.HistoryFile, f.History.File)
+	setInt(&c.HistoryMaxSize, f.History.MaxSize)
+	setInt(&c.HistoryKeep, f.History.Keep)
+	setString(&c.ActivePortFile, f.ActivePort.File)
+	setString(&c.ActivePortFormat, f.ActivePort.Format)
+	c.ActivePortFiles = f.ActivePort.Files
+	c.Targets = append(c.Targets, f.Targets...)
+	c.SourceList = f.Sources
+	setInt(&c.NotifyFailures, f.Notify.Failures)
+	setInt(&c.NotifyInterval, f.Notify.Interval)
+	c.Notifiers = f.Notify.Notifiers
+	setInt(&c.HookTimeout, f.HookTimeout)
+	setInt(&c.HookConcurrency, f.HookConcurrency)
+	c.Hooks = f.Hooks
+	c.Templates = f.Templates
+}
+
+func setString(dst *string, v string) {
+	if v != "" {
+		*dst = v
+	}
+}
+
+func setInt(dst *int, v int) {
+	if v != 0 {
+		*dst = v
+	}
+}
+
+// readConfigFile reads a YAML or TOML config file into a Config.
+// The format is chosen by the file extension.
+// Unknown keys are reported as errors.
+func readConfigFile(path string) (Config, error) {
+	var config Config
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return config, err
+	}
+	// apply whatever was decoded even on errors, so that the
+	// rest of the config can still be validated
+	f, err := decodeConfigFile(b, filepath.Ext(path))
+	f.apply(&config)
+	if err != nil {
+		return config, fmt.Errorf("%s: %w", path, err)
+	}
+	return config, nil
+}
+
+// decodeConfigFile decodes a config file in the format given by ext.
+func decodeConfigFile(b []byte, ext string) (fileConfig, error) {
+	var f fileConfig
+	switch strings.ToLower(ext) {
+	case ".yaml", ".yml":
+		decoder := yaml.NewDecoder(bytes.NewReader(b))
+		decoder.KnownFields(true)
+		err := decoder.Decode(&f)
+		if errors.Is(err, io.EOF) {
+			// an empty file is a valid, empty config
+			return f, nil
+		}
+		return f, err
+	case ".toml":
+		md, err := toml.Decode(string(b), &f)
+		if err != nil {
+			return f, err
+		}
+		var errs []error
+		for _, key := range md.Undecoded() {
+			errs = append(errs, fmt.Errorf("unknown key %q", key.String()))
+		}
+		return f, errors.Join(errs...)
+	default:
+		return f, fmt.Errorf("unsupported config file extension %q, use .yaml, .yml or .toml", ext)
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestReadConfigFile(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	tt := []struct {
+		name     string
+		file     string
+		contents string
+		expected Config
+		hasErr   bool
+	}{
+		{
+			name: "yaml",
+			file: "gluebit.yaml",
+			contents: `
+interval: 30
+gluetun:
+  host: gluetun
+  port: 8001
+qbittorrent:
+  host: qbit
+  username: admin
+targets:
+  - name: seedbox
+    host: seedbox.lan
+    port: 8081
+    password: secret
+    port_index: 1
+`,
+			expected: Config{
+				QbitHost:       "qbit",
+				QbitUsername:   "admin",
+				GlueTunHost:    "gluetun",
+				GlueTunPort:    8001,
+				UpdateInterval: 30,
+				Targets:        []Target{{Name: "seedbox", Host: "seedbox.lan", Port: 8081, Password: "secret", PortIndex: 1}},
+			},
+		},
+		{
+			name: "toml",
+			file: "gluebit.toml",
+			contents: `
+interval = 30
+
+[gluetun]
+portfile = "/tmp/gluetun/forwarded_port"
+
+[[targets]]
+name = "seedbox"
+host = "seedbox.lan"
+port = 8081
+
+[targets.translate.table]
+51413 = 6881
+`,
+			expected: Config{
+				GlueTunPortFile: "/tmp/gluetun/forwarded_port",
+				UpdateInterval:  30,
+				Targets: []Target{{
+					Name: "seedbox", Host: "seedbox.lan", Port: 8081,
+					Translate: PortRule{Table: map[string]int{"51413": 6881}},
+				}},
+			},
+		},
+		{
+			name: "static port",
+			file: "static.yaml",
+			contents: `
+static:
+  port: 51413
+`,
+			expected: Config{StaticPort: 51413},
+		},
+		{
+			name: "notify",
+			file: "notify.yaml",
+			contents: `
+notify:
+  failures: 5
+  interval: 600
+  notifiers:
+    - type: webhook
+      url: https://chat.lan/hooks/gluebit
+      headers:
+        Authorization: Bearer token
+      body: '{"text": {{json .Message}}}'
+      events: [port_changed, recovered]
+`,
+			expected: Config{
+				NotifyFailures: 5,
+				NotifyInterval: 600,
+				Notifiers: []NotifierSpec{{
+					Type: "webhook", URL: "https://chat.lan/hooks/gluebit",
+					Headers: map[string]string{"Authorization": "Bearer token"},
+					Body:    `{"text": {{json .Message}}}`,
+					Events:  []string{"port_changed", "recovered"},
+				}},
+			},
+		},
+		{
+			name: "active port files",
+			file: "active.yaml",
+			contents: `
+active_port:
+  file: /shared/port
+  files:
+    - file: /shared/qbittorrent.env
+      format: dotenv
+    - file: /shared/port.json
+      format: json
+`,
+			expected: Config{
+				ActivePortFile: "/shared/port",
+				ActivePortFiles: []ActivePortSpec{
+					{File: "/shared/qbittorrent.env", Format: "dotenv"},
+					{File: "/shared/port.json", Format: "json"},
+				},
+			},
+		},
+		{
+			name:     "empty yaml",
+			file:     "empty.yml",
+			contents: "",
+			expected: Config{},
+		},
+		{
+			name:     "unknown yaml key",
+			file:     "unknown.yaml",
+			contents: "intervall: 30\n",
+			hasErr:   true,
+		},
+		{
+			name:     "unknown toml key",
+			file:     "unknown.toml",
+			contents: "[gluetun]\nhots = \"gluetun\"\n",
+			hasErr:   true,
+		},
+		{
+			name:     "unsupported extension",
+			file:     "gluebit.json",
+			contents: "{}",
+			hasErr:   true,
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(dir, tc.file)
+			if err := os.WriteFile(path, []byte(tc.contents), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			config, err := readConfigFile(path)
+			if tc.hasErr && err == nil {
+				t.Fatal("Expected error, got nil")
+			}
+			if !tc.hasErr && err != nil {
+				t.Fatal(err)
+			}
+			if tc.hasErr {
+				return
+			}
+			if config.QbitHost != tc.expected.QbitHost ||
+				config.QbitUsername != tc.expected.QbitUsername ||
+				config.GlueTunHost != tc.expected.GlueTunHost ||
+				config.GlueTunPort != tc.expected.GlueTunPort ||
+				config.GlueTunPortFile != tc.expected.GlueTunPortFile ||
+				config.UpdateInterval != tc.expected.UpdateInterval ||
+				config.NotifyFailures != tc.expected.NotifyFailures ||
+				config.NotifyInterval != tc.expected.NotifyInterval ||
+				!reflect.DeepEqual(config.Notifiers, tc.expected.Notifiers) {
+				t.Errorf("Expected config %+v, got %+v", tc.expected, config)
+			}
+			if len(config.Targets) != len(tc.expected.Targets) {
+				t.Fatalf("Expected targets %+v, got %+v", tc.expected.Targets, config.Targets)
+			}
+			for i := range config.Targets {
+				if !reflect.DeepEqual(config.Targets[i], tc.expected.Targets[i]) {
+					t.Errorf("Expected target %+v, got %+v", tc.expected.Targets[i], config.Targets[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+)
+
+// Exit codes of the commands.
+const (
+	exitOK     = 0 // the command succeeded, the port is in sync
+	exitFailed = 1 // the command failed
+	exitNoPort = 2 // no port is forwarded yet, qbittorrent was left unchanged
+	exitDryRun = 3 // with --dry-run, the port would have been changed
+)
+
+// TargetCmd holds the options of commands that act on one qbittorrent target.
+type TargetCmd struct {
+	Target string `arg:"--target" help:"name of the target, the main qbittorrent instance by default"`
+}
+
+// SetCmd holds the arguments of "gluebit set".
+type SetCmd struct {
+	Port int `arg:"positional,required" help:"port for qbittorrent to listen on"`
+	TargetCmd
+}
+
+// fixedPort is a GlueGetter that returns the same port, to set a port by hand.
+type fixedPort int
+
+func (p fixedPort) GetGlueTunPort(Config, HttpDoer) (int, error) {
+	return int(p), nil
+}
+
+// runCommand runs the subcommand given on the command line and returns its exit code.
+// It returns false if there is no subcommand other than daemon.
+// Commands run once, whatever the --interval. Problems are the problems of
+// an invalid config, see loadConfig.
+func runCommand(w io.Writer, config Config, problems error) (int, bool) {
+	once := config
+	once.UpdateInterval = 0
+	switch {
+	case config.ConfigCmd != nil:
+		return validateConfig(w, problems), true
+	case config.StatusCmd != nil:
+		return printStatus(w, config), true
+	case config.HistoryCmd != nil:
+		return printHistory(w, config, config.HistoryCmd, time.Now()), true
+	case config.GluetunPortCmd != nil:
+		return printForwardedPorts(w, once), true
+	case config.QbitPortCmd != nil:
+		return printQbitPort(w, once, config.QbitPortCmd.Target), true
+	case config.SetCmd != nil:
+		return setQbitPort(once, config.SetCmd), true
+	case config.SyncCmd != nil:
+		return syncOnce(once), true
+	case config.DoctorCmd != nil:
+		return runDoctor(w, once), true
+	}
+	return 0, false
+}
+
+// daemon implements "gluebit daemon", which is also run without a command.
+// It keeps the port in sync until the program is stopped, or syncs once if
+// --interval is 0.
+func daemon(config Config) {
+	ctx := context.Background()
+	state, err := readState(config.stateFile())
+	if err != nil {
+		logger("state").Warn("Failed to read state, starting without it", "error", err)
+	}
+	if len(state.Ports) > 0 {
+		logger("state").Info("Loaded last good port", "ports", state.Ports, "source", state.Source, "updated", state.Updated)
+	}
+	reloads := make(chan Config)
+	go watchConfig(ctx, config, reloads)
+	run(ctx, config, &debouncer{glue: &sourceChain{}, stable: state.Ports, suppressed: state.SuppressedFlaps}, &state, reloads)
+}
+
+// printForwardedPorts implements "gluebit gluetun-port".
+// It prints the ports of the first port source that has any, one per line.
+func printForwardedPorts(w io.Writer, config Config) int {
+	chain := &sourceChain{}
+	ports, err := chain.GetGlueTunPorts(config, &http.Client{})
+	if err == nil {
+		err = checkForwardedPorts(ports)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return errorExitCode(err)
+	}
+	for _, port := range ports {
+		fmt.Fprintln(w, port)
+	}
+	return exitOK
+}
+
+// printQbitPort implements "gluebit qbit-port".
+// It prints the port the target listens on.
+func printQbitPort(w io.Writer, config Config, name string) int {
+	target, err := config.target(name)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFailed
+	}
+	client, err := newQbitClient(target)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", target.Name, err)
+		return exitFailed
+	}
+	pref, err := client.GetPreferences()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", target.Name, err)
+		return exitFailed
+	}
+	fmt.Fprintln(w, pref.ListenPort)
+	return exitOK
+}
+
+// setQbitPort implements "gluebit set".
+// The port is set as is, without the translation or port index of the target,
+// but it must be in the allowed range.
+func setQbitPort(config Config, cmd *SetCmd) int {
+	target, err := config.target(cmd.Target)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFailed
+	}
+	target.Translate = PortRule{}
+	target.PortIndex = 0
+	client, err := newQbitClient(target)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", target.Name, err)
+		return exitFailed
+	}
+	if _, _, err := setPort(config, target, client, fixedPort(cmd.Port)); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", target.Name, err)
+		return errorExitCode(err)
+	}
+	return exitOK
+}
+
+// syncOnce implements "gluebit sync".
+// It sets the port of every target once, records the results in the state
+// and returns exitOK if every target is in sync.
+func syncOnce(config Config) int {
+	state, err := readState(config.stateFile())
+	if err != nil {
+		logger("state").Warn("Failed to read state, starting without it", "error", err)
+	}
+	events := newEventTracker(state)
+	errs := update(config, newQbitClients(), &sourceChain{}, &state, events)
+	events.wait()
+	return errorExitCode(errors.Join(errs...))
+}
+
+// errorExitCode returns the exit code for err, which may join the errors of
+// several targets: exitFailed if any of them failed, or else exitDryRun if a
+// port would have been changed, or else exitNoPort if no port is forwarded yet.
+func errorExitCode(err error) int {
+	if err == nil {
+		return exitOK
+	}
+	errs := []error{err}
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		errs = joined.Unwrap()
+	}
+	code := exitNoPort
+	for _, e := range errs {
+		switch {
+		case errors.Is(e, ErrDryRun):
+			code = exitDryRun
+		case !errors.Is(e, ErrNoPort):
+			return exitFailed
+		}
+	}
+	return code
+}
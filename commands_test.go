@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// qbitServer is a stand-in for the qbittorrent api that keeps the listen port.
+type qbitServer struct {
+	*httptest.Server
+	mu   sync.Mutex
+	port int
+}
+
+func startQbitServer(t *testing.T, port int) *qbitServer {
+	s := &qbitServer{port: port}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		switch r.URL.Path {
+		case "/api/v2/auth/login":
+			w.Write([]byte(ResponseBodyOK))
+		case "/api/v2/app/version":
+			w.Write([]byte("v4.6.0"))
+		case "/api/v2/app/preferences":
+			fmt.Fprintf(w, `{"listen_port": %d}`, s.port)
+		case "/api/v2/app/setPreferences":
+			var pref Preferences
+			if err := json.Unmarshal([]byte(r.FormValue("json")), &pref); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			s.port = pref.ListenPort
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *qbitServer) listenPort() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.port
+}
+
+// startGluetunServer starts a stand-in for the gluetun control server that returns body.
+func startGluetunServer(t *testing.T, body string) *httptest.Server {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestPrintForwardedPorts(t *testing.T) {
+	t.Parallel()
+
+	tt := []struct {
+		name     string
+		url      string
+		wantCode int
+		want     string
+	}{
+		{name: "ports", url: startGluetunServer(t, `{"ports": [51413, 51414]}`).URL, want: "51413\n51414\n"},
+		{name: "no port yet", url: startGluetunServer(t, `{"port": 0}`).URL, wantCode: exitNoPort},
+		{name: "unreachable", url: "http://127.0.0.1:1", wantCode: exitFailed},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			var out bytes.Buffer
+			if code := printForwardedPorts(&out, Config{GlueTunUrl: tc.url}); code != tc.wantCode {
+				t.Errorf("Expected exit code %d, got %d", tc.wantCode, code)
+			}
+			if out.String() != tc.want {
+				t.Errorf("Expected output %q, got %q", tc.want, out.String())
+			}
+		})
+	}
+}
+
+func TestQbitPortCommands(t *testing.T) {
+	t.Parallel()
+
+	primary := startQbitServer(t, 6881)
+	seedbox := startQbitServer(t, 6882)
+	config := Config{
+		QbitUrl: primary.URL,
+		Targets: []Target{{Name: "seedbox", URL: seedbox.URL}},
+	}
+
+	var out bytes.Buffer
+	if code := printQbitPort(&out, config, "seedbox"); code != exitOK || out.String() != "6882\n" {
+		t.Errorf("Expected port 6882 and exit code 0, got %q and %d", out.String(), code)
+	}
+	if code := printQbitPort(&out, config, "other"); code != exitFailed {
+		t.Errorf("Expected exit code %d for an unknown target, got %d", exitFailed, code)
+	}
+
+	// the port is set as is, without translation
+	config.QbitListenPort = 7000
+	if code := setQbitPort(config, &SetCmd{Port: 51413}); code != exitOK {
+		t.Errorf("Expected exit code 0, got %d", code)
+	}
+	if port := primary.listenPort(); port != 51413 {
+		t.Errorf("Expected port %d, got %d", 51413, port)
+	}
+	// but it must be in the allowed range
+	if code := setQbitPort(config, &SetCmd{Port: 80, TargetCmd: TargetCmd{Target: "seedbox"}}); code != exitFailed {
+		t.Errorf("Expected exit code %d, got %d", exitFailed, code)
+	}
+	if port := seedbox.listenPort(); port != 6882 {
+		t.Errorf("Expected port %d to be kept, got %d", 6882, port)
+	}
+}
+
+func TestSyncOnce(t *testing.T) {
+	t.Parallel()
+
+	tt := []struct {
+		name     string
+		gluetun  string
+		dryRun   bool
+		wantCode int
+		wantPort int
+	}{
+		{name: "synced", gluetun: `{"port": 51413}`, wantPort: 51413},
+		{name: "no port yet", gluetun: `{"port": 0}`, wantCode: exitNoPort, wantPort: 6881},
+		{name: "invalid port", gluetun: `{"port": 80}`, wantCode: exitFailed, wantPort: 6881},
+		{name: "dry run", gluetun: `{"port": 51413}`, dryRun: true, wantCode: exitDryRun, wantPort: 6881},
+		{name: "dry run in sync", gluetun: `{"port": 6881}`, dryRun: true, wantPort: 6881},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			qbit := startQbitServer(t, 6881)
+			config := Config{
+				QbitUrl:    qbit.URL,
+				GlueTunUrl: startGluetunServer(t, tc.gluetun).URL,
+				StateDir:   t.TempDir(),
+				DryRun:     tc.dryRun,
+			}
+			if code := syncOnce(config); code != tc.wantCode {
+				t.Errorf("Expected exit code %d, got %d", tc.wantCode, code)
+			}
+			if port := qbit.listenPort(); port != tc.wantPort {
+				t.Errorf("Expected port %d, got %d", tc.wantPort, port)
+			}
+			state, err := readState(config.stateFile())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := state.Targets["qbittorrent"]; ok == tc.dryRun {
+				t.Errorf("Expected the result to be saved only without --dry-run, got %+v", state)
+			}
+		})
+	}
+}
+
+func TestErrorExitCode(t *testing.T) {
+	t.Parallel()
+
+	failed := errors.New("connection refused")
+	tt := []struct {
+		err  error
+		want int
+	}{
+		{err: nil, want: exitOK},
+		{err: failed, want: exitFailed},
+		{err: fmt.Errorf("qbittorrent: %w", ErrNoPort), want: exitNoPort},
+		{err: errors.Join(fmt.Errorf("a: %w", ErrNoPort), fmt.Errorf("b: %w", ErrNoPort)), want: exitNoPort},
+		{err: errors.Join(fmt.Errorf("a: %w", ErrNoPort), failed), want: exitFailed},
+		{err: errors.Join(fmt.Errorf("a: %w", ErrNoPort), fmt.Errorf("b: %w", ErrDryRun)), want: exitDryRun},
+		{err: errors.Join(fmt.Errorf("a: %w", ErrDryRun), failed), want: exitFailed},
+	}
+	for _, tc := range tt {
+		if got := errorExitCode(tc.err); got != tc.want {
+			t.Errorf("errorExitCode(%v) = %d, want %d", tc.err, got, tc.want)
+		}
+	}
+}
+
+func TestUpdateUnreachableTarget(t *testing.T) {
+	t.Parallel()
+
+	qbit := startQbitServer(t, 6881)
+	config := Config{
+		QbitUrl:    qbit.URL,
+		GlueTunUrl: startGluetunServer(t, `{"port": 51413}`).URL,
+		Targets:    []Target{{Name: "down", URL: "http://127.0.0.1:1"}},
+	}
+	clients := newQbitClients()
+	var state State
+	// the unreachable target fails on its own, every update
+	for i := 0; i < 2; i++ {
+		errs := update(config, clients, &sourceChain{}, &state, newEventTracker(State{}))
+		if len(errs) != 1 || !strings.HasPrefix(errs[0].Error(), "down: ") {
+			t.Fatalf("Expected only the down target to fail, got %v", errs)
+		}
+	}
+	if port := qbit.listenPort(); port != 51413 {
+		t.Errorf("Expected the reachable target to be synced to 51413, got %d", port)
+	}
+	if _, ok := clients.clients["down"]; ok {
+		t.Error("Expected no client to be kept for the unreachable target")
+	}
+	if state.Targets["down"].Error == "" {
+		t.Errorf("Expected the error of the unreachable target in the state, got %+v", state.Targets["down"])
+	}
+}
+
+func TestQbitClientsLogin(t *testing.T) {
+	t.Parallel()
+
+	var mu sync.Mutex
+	logins := 0
+	unavailable := 2
+	password := "wrong"
+	qbit := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		logins++
+		switch {
+		case unavailable > 0:
+			unavailable--
+			http.Error(w, "starting", http.StatusServiceUnavailable)
+		case r.FormValue("password") != password:
+			w.Write([]byte("Fails."))
+		default:
+			w.Write([]byte(ResponseBodyOK))
+		}
+	}))
+	t.Cleanup(qbit.Close)
+	count := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		n := logins
+		logins = 0
+		return n
+	}
+
+	config := Config{UpdateInterval: 60}
+	target := Target{Name: "qbittorrent", URL: qbit.URL, Password: "secret"}
+	clients := newQbitClients()
+	clients.delay = 0
+
+	// the first connection is retried until qbittorrent is up, but a failed
+	// login is not tried again until the config is reloaded
+	for i := 0; i < 2; i++ {
+		if _, err := clients.get(config, target); !errors.Is(err, ErrLoginfailed) {
+			t.Fatalf("Expected login failed, got %v", err)
+		}
+	}
+	if n := count(); n != 3 {
+		t.Errorf("Expected 2 retries and 1 login, got %d requests", n)
+	}
+
+	mu.Lock()
+	password = "secret"
+	mu.Unlock()
+	clients.reload(nil)
+	if _, err := clients.get(config, target); err != nil {
+		t.Fatal(err)
+	}
+	if n := count(); n != 1 {
+		t.Errorf("Expected 1 login after the reload, got %d", n)
+	}
+
+	// once connected, connection errors are not retried within an update
+	clients.logout(target.Name)
+	mu.Lock()
+	unavailable = 1
+	mu.Unlock()
+	if _, err := clients.get(config, target); err == nil {
+		t.Error("Expected error, got nil")
+	}
+	if n := count(); n != 1 {
+		t.Errorf("Expected 1 login attempt, got %d", n)
+	}
+}
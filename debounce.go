@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// debouncer only passes on new ports once they are stable, so that ports
+// reported briefly during unstable reconnects do not make qbittorrent restart
+// its listener again and again. A port is stable once it has been read
+// --stablereads times in a row and for at least --stabletime seconds.
+// Until then, the last stable ports are returned. With --keeplastport, they are
+// also returned while no source has a port. It implements GlueGetter and PortsGetter.
+type debouncer struct {
+	glue GlueGetter
+	now  func() time.Time // for tests, time.Now if nil
+
+	mu         sync.Mutex
+	stable     []int     // the ports passed on, initially the last good ports of the state
+	candidate  []int     // new ports that are not stable yet
+	since      time.Time // when candidate was first read
+	reads      int       // how often candidate was read in a row
+	suppressed int       // candidates that changed before they were stable
+	observed   []int     // the ports last read, stable or not
+}
+
+// GetGlueTunPort returns the first stable port.
+func (d *debouncer) GetGlueTunPort(config Config, client HttpDoer) (int, error) {
+	return firstPort(d.GetGlueTunPorts(config, client))
+}
+
+// GetGlueTunPorts reads the ports and returns the stable ones.
+// Errors are returned as is and do not reset the candidate.
+func (d *debouncer) GetGlueTunPorts(config Config, client HttpDoer) ([]int, error) {
+	ports, err := getPorts(d.glue, config, client)
+	if err == nil {
+		err = checkForwardedPorts(ports)
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.observed = nil
+	if err != nil {
+		if config.KeepLastPort && d.stable != nil {
+			logger("source").Warn("No port from the port sources, keeping the last good port", "ports", d.stable, "error", err)
+			return d.stable, nil
+		}
+		return nil, err
+	}
+	d.observed = ports
+	now := time.Now()
+	if d.now != nil {
+		now = d.now()
+	}
+	switch {
+	case d.stable != nil && equalPorts(ports, d.stable):
+		if d.candidate != nil {
+			d.suppress(ports)
+		}
+		d.candidate = nil
+		return d.stable, nil
+	case d.candidate != nil && equalPorts(ports, d.candidate):
+		d.reads++
+	default:
+		if d.candidate != nil {
+			d.suppress(ports)
+		}
+		d.candidate = ports
+		d.since = now
+		d.reads = 1
+	}
+	wait := time.Duration(config.StableTime)*time.Second - now.Sub(d.since)
+	if d.reads >= config.StableReads && wait <= 0 {
+		d.stable = d.candidate
+		d.candidate = nil
+		return d.stable, nil
+	}
+	logger("source").Debug("Waiting for port to stabilize", "ports", d.candidate, "reads", d.reads, "wait", wait)
+	if d.stable == nil {
+		return nil, fmt.Errorf("%w: port %v is not stable yet", ErrNoPort, d.candidate)
+	}
+	return d.stable, nil
+}
+
+// suppress counts and logs a candidate that was replaced by ports before it was stable.
+// d.mu must be held.
+func (d *debouncer) suppress(ports []int) {
+	d.suppressed++
+	logger("source").Info("Suppressed flapping port", "ports", d.candidate, "replaced_by", ports, "suppressed_flaps", d.suppressed)
+}
+
+// Source returns the source of the last ports, if known.
+func (d *debouncer) Source() string {
+	if s, ok := d.glue.(sourcer); ok {
+		return s.Source()
+	}
+	return ""
+}
+
+// flapCounter is a GlueGetter that counts suppressed flapping ports.
+type flapCounter interface {
+	Suppressed() int
+}
+
+// Suppressed returns how many flapping ports were suppressed, including the
+// ones of the state it started with.
+func (d *debouncer) Suppressed() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.suppressed
+}
+
+// portObserver is a GlueGetter that knows the ports last read from the port
+// sources, before they were debounced.
+type portObserver interface {
+	Observed() []int
+}
+
+// Observed returns the ports of the last read, including the ones that are
+// not stable yet, or nil if it failed.
+func (d *debouncer) Observed() []int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.observed
+}
+
+// equalPorts reports whether a and b hold the same ports in the same order.
+func equalPorts(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// portSequence returns the next ports on every read.
+type portSequence struct {
+	ports [][]int
+	reads int
+}
+
+func (s *portSequence) GetGlueTunPort(config Config, client HttpDoer) (int, error) {
+	return firstPort(s.GetGlueTunPorts(config, client))
+}
+
+func (s *portSequence) GetGlueTunPorts(Config, HttpDoer) ([]int, error) {
+	ports := s.ports[s.reads]
+	s.reads++
+	if ports == nil {
+		return nil, errors.New("gluetun is down")
+	}
+	return ports, nil
+}
+
+func TestDebouncer(t *testing.T) {
+	t.Parallel()
+
+	tt := []struct {
+		name           string
+		config         Config
+		reads          [][]int
+		want           []int // the first port returned on every read, 0 for an error
+		wantSuppressed int
+	}{
+		{
+			name:   "disabled",
+			config: Config{StableReads: 1},
+			reads:  [][]int{{1111}, {2222}, {1111}},
+			want:   []int{1111, 2222, 1111},
+		},
+		{
+			name:   "stable after reads",
+			config: Config{StableReads: 3},
+			reads:  [][]int{{1111}, {1111}, {1111}, {2222}, {2222}, {2222}},
+			want:   []int{0, 0, 1111, 1111, 1111, 2222},
+		},
+		{
+			name:           "flapping ports are suppressed",
+			config:         Config{StableReads: 2},
+			reads:          [][]int{{1111}, {1111}, {2222}, {1111}, {3333}, {4444}, {4444}},
+			want:           []int{0, 1111, 1111, 1111, 1111, 1111, 4444},
+			wantSuppressed: 2,
+		},
+		{
+			name:   "errors do not reset the candidate",
+			config: Config{StableReads: 3},
+			reads:  [][]int{{1111}, {1111}, nil, {1111}},
+			want:   []int{0, 0, 0, 1111},
+		},
+		{
+			name:   "stable after time",
+			config: Config{StableReads: 1, StableTime: 90},
+			reads:  [][]int{{1111}, {1111}, {1111}, {2222}},
+			want:   []int{0, 0, 1111, 1111},
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			now := time.Now()
+			d := &debouncer{
+				glue: &portSequence{ports: tc.reads},
+				now:  func() time.Time { return now },
+			}
+			var got []int
+			for range tc.reads {
+				port, err := d.GetGlueTunPort(tc.config, http.DefaultClient)
+				if err != nil {
+					port = 0
+				}
+				got = append(got, port)
+				now = now.Add(time.Minute)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("Expected ports %v, got %v", tc.want, got)
+			}
+			if d.Suppressed() != tc.wantSuppressed {
+				t.Errorf("Expected %d suppressed flaps, got %d", tc.wantSuppressed, d.Suppressed())
+			}
+		})
+	}
+}
+
+func TestDebouncerNotStable(t *testing.T) {
+	t.Parallel()
+
+	// until the first port is stable, qbittorrent keeps its port
+	d := &debouncer{glue: &mockGlueGetter{port: 1111}}
+	if _, err := d.GetGlueTunPort(Config{StableReads: 2}, http.DefaultClient); !errors.Is(err, ErrNoPort) {
+		t.Errorf("Expected error %v, got %v", ErrNoPort, err)
+	}
+}
+
+func TestUpdateSavesSuppressedFlaps(t *testing.T) {
+	t.Parallel()
+
+	config := Config{
+		QbitUrl:    startQbitServer(t, 6881).URL,
+		GlueTunUrl: startGluetunServer(t, `{"port": 51413}`).URL,
+		StateDir:   t.TempDir(),
+	}
+	state := State{SuppressedFlaps: 2}
+	glue := &debouncer{glue: &sourceChain{}, suppressed: state.SuppressedFlaps}
+	update(config, newQbitClients(), glue, &state, newEventTracker(state))
+	saved, err := readState(config.stateFile())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.SuppressedFlaps != 2 {
+		t.Errorf("Expected 2 suppressed flaps in the state, got %d", saved.SuppressedFlaps)
+	}
+}
+
+func TestUpdateRecordsFlappingPorts(t *testing.T) {
+	t.Parallel()
+
+	config := Config{
+		QbitUrl:     startQbitServer(t, 51413).URL,
+		StableReads: 2,
+		HistoryFile: filepath.Join(t.TempDir(), "history.jsonl"),
+	}
+	state := State{Ports: []int{51413}, Targets: map[string]TargetState{"qbittorrent": {Port: 51413}}}
+	glue := &debouncer{glue: &portSequence{ports: [][]int{{52000}, {51413}}}, stable: state.Ports}
+	events := newEventTracker(state)
+	clients := newQbitClients()
+	for i := 0; i < 2; i++ {
+		update(config, clients, glue, &state, events)
+	}
+
+	// the suppressed port is recorded, although it was never passed on
+	var observed [][]int
+	err := readHistory(config.HistoryFile, 0, func(r HistoryRecord) bool {
+		if r.Type == HistoryObserved {
+			observed = append(observed, r.Ports)
+		}
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := [][]int{{52000}, {51413}}; !reflect.DeepEqual(observed, want) {
+		t.Errorf("Expected observed ports %v, got %v", want, observed)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// discord posts events as embeds to a Discord webhook.
+// Urgent events (priority 5) mention @here.
+type discord struct {
+	spec   NotifierSpec
+	client HttpDoer
+}
+
+func newDiscord(spec NotifierSpec) Notifier {
+	return discord{spec: spec, client: http.DefaultClient}
+}
+
+func (d discord) Notify(ctx context.Context, event Event) error {
+	type embed struct {
+		Title       string `json:"title"`
+		Description string `json:"description"`
+		Color       int    `json:"color"`
+		Timestamp   string `json:"timestamp,omitempty"`
+	}
+	msg := struct {
+		Username string  `json:"username"`
+		Content  string  `json:"content,omitempty"`
+		Embeds   []embed `json:"embeds"`
+	}{
+		Username: "gluebit",
+		Embeds: []embed{{
+			Title:       title(event),
+			Description: event.Message,
+			Color:       eventStyles[event.Type].color,
+		}},
+	}
+	if !event.Time.IsZero() {
+		msg.Embeds[0].Timestamp = event.Time.Format(time.RFC3339)
+	}
+	if d.spec.priority(event.Type) >= 5 {
+		msg.Content = "@here"
+	}
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	req, err := newNotifyRequest(ctx, d.spec, d.spec.URL, "application/json", body)
+	if err != nil {
+		return err
+	}
+	return postNotification(d.client, req)
+}
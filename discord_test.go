@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestDiscord(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	tt := []struct {
+		name        string
+		spec        NotifierSpec
+		event       Event
+		wantColor   int
+		wantContent string
+	}{
+		{
+			name:      "recovered",
+			event:     Event{Type: EventRecovered, Message: "Port 52000 is forwarded again", Time: now},
+			wantColor: 0x2ecc71,
+		},
+		{
+			name:        "urgent mentions here",
+			spec:        NotifierSpec{Priorities: map[string]int{"sync_failed": 5}},
+			event:       Event{Type: EventSyncFailed, Message: "qbittorrent: sync failed 3 times in a row", Time: now},
+			wantColor:   0xe67e22,
+			wantContent: "@here",
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			server := startNotifyServer(t, 204)
+			spec := tc.spec
+			spec.URL = server.URL + "/api/webhooks/1/token"
+			if err := newDiscord(spec).Notify(context.Background(), tc.event); err != nil {
+				t.Fatal(err)
+			}
+			_, bodies := server.received()
+			if len(bodies) != 1 {
+				t.Fatalf("Expected 1 request, got %d", len(bodies))
+			}
+			var msg struct {
+				Username string `json:"username"`
+				Content  string `json:"content"`
+				Embeds   []struct {
+					Title       string `json:"title"`
+					Description string `json:"description"`
+					Color       int    `json:"color"`
+					Timestamp   string `json:"timestamp"`
+				} `json:"embeds"`
+			}
+			if err := json.Unmarshal([]byte(bodies[0]), &msg); err != nil {
+				t.Fatal(err)
+			}
+			if msg.Content != tc.wantContent {
+				t.Errorf("Expected content %q, got %q", tc.wantContent, msg.Content)
+			}
+			if len(msg.Embeds) != 1 {
+				t.Fatalf("Expected 1 embed, got %+v", msg)
+			}
+			e := msg.Embeds[0]
+			if e.Title != title(tc.event) || e.Description != tc.event.Message || e.Color != tc.wantColor || e.Timestamp != "2026-10-18T12:00:00Z" {
+				t.Errorf("Unexpected embed %+v", e)
+			}
+		})
+	}
+}
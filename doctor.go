@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// doctorTimeout bounds every check of "gluebit doctor".
+var doctorTimeout = 5 * time.Second
+
+// doctorStep is one check of "gluebit doctor". It returns what it found if it
+// passes, or an error, optionally wrapped with withHint, if it fails.
+type doctorStep struct {
+	name string
+	run  func(ctx context.Context) (string, error)
+}
+
+// hintError is an error with advice on how to fix it.
+type hintError struct {
+	err  error
+	hint string
+}
+
+func (e *hintError) Error() string { return e.err.Error() }
+func (e *hintError) Unwrap() error { return e.err }
+
+// withHint adds a hint to err.
+func withHint(err error, format string, args ...any) error {
+	return &hintError{err: err, hint: fmt.Sprintf(format, args...)}
+}
+
+// runDoctor implements "gluebit doctor".
+// It checks every step needed to sync the port, from resolving the hosts of
+// gluetun and qbittorrent to reading the qbittorrent preferences, and prints
+// a report with hints for the failed steps. Once a step fails, the later steps
+// of the same service are skipped. It returns exitOK if every step passed.
+func runDoctor(w io.Writer, config Config) int {
+	var groups [][]doctorStep
+	for _, spec := range config.sources() {
+		if spec.Type == "gluetun-api" {
+			groups = append(groups, gluetunSteps(config))
+		}
+	}
+	groups = append(groups, []doctorStep{{name: "port sources: port", run: func(context.Context) (string, error) {
+		return checkSourcePorts(config)
+	}}})
+	for _, target := range config.targets() {
+		groups = append(groups, qbitSteps(target))
+	}
+
+	code := exitOK
+	for _, steps := range groups {
+		failed := false
+		for _, step := range steps {
+			if failed {
+				fmt.Fprintf(w, "[SKIP] %s\n", step.name)
+				continue
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), doctorTimeout)
+			detail, err := step.run(ctx)
+			cancel()
+			if err == nil {
+				fmt.Fprintf(w, "[ OK ] %s: %s\n", step.name, detail)
+				continue
+			}
+			failed = true
+			code = exitFailed
+			fmt.Fprintf(w, "[FAIL] %s: %s\n", step.name, err)
+			var hint *hintError
+			if errors.As(err, &hint) {
+				fmt.Fprintf(w, "       hint: %s\n", hint.hint)
+			}
+		}
+	}
+	return code
+}
+
+// gluetunSteps returns the checks of gluetun's control server.
+func gluetunSteps(config Config) []doctorStep {
+	rawUrl := config.gluetunUrl()
+	var client HttpDoer
+	return []doctorStep{
+		{name: "gluetun: resolve", run: func(ctx context.Context) (string, error) {
+			return resolveHost(ctx, rawUrl, "gluetun")
+		}},
+		{name: "gluetun: connect", run: func(ctx context.Context) (string, error) {
+			return connectHost(ctx, rawUrl, "gluetun", 8000, "HTTP_CONTROL_SERVER_ADDRESS in gluetun")
+		}},
+		{name: "gluetun: port forwarding route", run: func(ctx context.Context) (string, error) {
+			var err error
+			if client, err = gluetunClient(config, http.DefaultClient); err != nil {
+				return "", err
+			}
+			var body port
+			if err := gluetunGet(ctx, client, rawUrl, "v1/openvpn/portforwarded", &body); err != nil {
+				return "", err
+			}
+			return "reachable", nil
+		}},
+		{name: "gluetun: VPN status", run: func(ctx context.Context) (string, error) {
+			var body struct {
+				Status string `json:"status"`
+			}
+			if err := gluetunGet(ctx, client, rawUrl, "v1/openvpn/status", &body); err != nil {
+				return "", err
+			}
+			if body.Status != "running" {
+				return "", withHint(fmt.Errorf("VPN is %s", body.Status),
+					"ports are only forwarded while the VPN runs, check the gluetun logs")
+			}
+			return body.Status, nil
+		}},
+	}
+}
+
+// checkSourcePorts gets the forwarded ports from the port sources and checks them.
+func checkSourcePorts(config Config) (string, error) {
+	chain := &sourceChain{}
+	ports, err := chain.GetGlueTunPorts(config, &http.Client{})
+	if err == nil {
+		err = checkForwardedPorts(ports)
+	}
+	if err == nil {
+		for _, p := range ports {
+			if err = config.allowedPorts().check(p); err != nil {
+				break
+			}
+		}
+	}
+	switch {
+	case errors.Is(err, ErrNoPort):
+		return "", withHint(err, "the VPN has not forwarded a port yet. Check that port forwarding is enabled, e.g. VPN_PORT_FORWARDING=on in gluetun, and that the VPN server supports it")
+	case errors.Is(err, ErrInvalidPort):
+		return "", withHint(err, "the port is outside of --minport and --maxport, check the port source or these options")
+	case err != nil:
+		return "", err
+	}
+	return fmt.Sprintf("%s from %s", formatPorts(ports), chain.Source()), nil
+}
+
+// qbitSteps returns the checks of a qbittorrent target.
+func qbitSteps(target Target) []doctorStep {
+	rawUrl := target.url()
+	name := target.Name
+	var client *Client
+	return []doctorStep{
+		{name: name + ": resolve", run: func(ctx context.Context) (string, error) {
+			return resolveHost(ctx, rawUrl, name)
+		}},
+		{name: name + ": connect", run: func(ctx context.Context) (string, error) {
+			return connectHost(ctx, rawUrl, name, 8080, "Options > WebUI > Port in qBittorrent")
+		}},
+		{name: name + ": version", run: func(context.Context) (string, error) {
+			httpClient, err := newHttpClient(target.TLS)
+			if err != nil {
+				return "", err
+			}
+			if client, err = newLoggedOutClient(httpClient, rawUrl); err != nil {
+				return "", err
+			}
+			version, err := client.Version()
+			var status *StatusError
+			switch {
+			case errors.As(err, &status) && status.StatusCode == http.StatusForbidden:
+				return "WebUI answered, the version needs a login", nil
+			case err != nil:
+				return "", qbitHint(err, rawUrl)
+			}
+			return version, nil
+		}},
+		{name: name + ": login", run: func(context.Context) (string, error) {
+			if err := client.Login(target.Username, target.Password); err != nil {
+				return "", qbitHint(err, rawUrl)
+			}
+			if target.Username == "" {
+				return "no username, relying on qBittorrent's authentication bypass", nil
+			}
+			return "logged in as " + target.Username, nil
+		}},
+		{name: name + ": preferences", run: func(context.Context) (string, error) {
+			pref, err := client.GetPreferences()
+			if err != nil {
+				return "", qbitHint(err, rawUrl)
+			}
+			return fmt.Sprintf("listening on port %d", pref.ListenPort), nil
+		}},
+	}
+}
+
+// qbitHint adds a hint to errors of qbittorrent's WebUI API.
+func qbitHint(err error, rawUrl string) error {
+	var status *StatusError
+	switch {
+	case errors.Is(err, ErrLoginfailed):
+		return withHint(err, "wrong username or password, check --qbituser and --qbitpass. qBittorrent bans the IP after too many failed logins")
+	case errors.As(err, &status) && status.StatusCode == http.StatusUnauthorized:
+		return withHint(err, "qBittorrent rejected the Host header or, behind a reverse proxy, the Origin or Referer header. Add the host of %s to Options > WebUI > Server domains, or turn off Host header validation or CSRF protection", rawUrl)
+	case errors.As(err, &status) && status.StatusCode == http.StatusForbidden:
+		return withHint(err, "qBittorrent banned this IP after too many failed logins, or the login was not accepted. Fix the credentials, then restart qBittorrent or wait for the ban to expire")
+	case errors.As(err, &status) && status.StatusCode == http.StatusNotFound:
+		return withHint(err, "%s is not qBittorrent's WebUI, check the port and path", rawUrl)
+	}
+	return httpHint(err, "qbittorrent")
+}
+
+// httpHint adds a hint to TLS errors of requests to service.
+func httpHint(err error, service string) error {
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostname x509.HostnameError
+	var verification *tls.CertificateVerificationError
+	var record tls.RecordHeaderError
+	switch {
+	case errors.As(err, &unknownAuthority), errors.As(err, &verification):
+		return withHint(err, "%s's certificate is not trusted, pass its CA certificate with --%scafile", service, tlsFlagPrefix(service))
+	case errors.As(err, &hostname):
+		return withHint(err, "%s's certificate is not valid for the host in its url", service)
+	case errors.As(err, &record):
+		return withHint(err, "%s does not speak https, use an http url", service)
+	}
+	return err
+}
+
+// tlsFlagPrefix returns the prefix of the TLS options of service.
+func tlsFlagPrefix(service string) string {
+	if service == "gluetun" {
+		return "gluetun"
+	}
+	return "qbit"
+}
+
+// resolveHost resolves the host of rawUrl.
+func resolveHost(ctx context.Context, rawUrl string, service string) (string, error) {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return "", err
+	}
+	host := u.Hostname()
+	if net.ParseIP(host) != nil {
+		return host + " is an IP address", nil
+	}
+	addrs, err := net.DefaultResolver.LookupHost(ctx, host)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return "", withHint(err, "%s is not a known host. In docker, use the container or service name of %s and put both containers in the same network, "+
+				"or use localhost if gluebit shares the network of the gluetun container", host, service)
+		}
+		return "", err
+	}
+	return fmt.Sprintf("%s is %s", host, strings.Join(addrs, ", ")), nil
+}
+
+// connectHost opens a TCP connection to the host of rawUrl.
+// defaultPort and setting are the port service listens on by default and where
+// it is set, for hints.
+func connectHost(ctx context.Context, rawUrl string, service string, defaultPort int, setting string) (string, error) {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return "", err
+	}
+	address := addressWithPort(u.Host, 80)
+	if u.Scheme == "https" {
+		address = addressWithPort(u.Host, 443)
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "", withHint(err, "nothing listens on %s. Check the port: %s listens on %d by default, set with %s", address, service, defaultPort, setting)
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, syscall.ETIMEDOUT):
+		return "", withHint(err, "no answer from %s. A firewall drops the connection, or %s is in another network", address, service)
+	case err != nil:
+		return "", err
+	}
+	conn.Close()
+	return "connected to " + address, nil
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// startDoctorServer starts a stand-in that answers every path in responses
+// with its status code and body, e.g. "200 Ok.", and every other path with 404.
+func startDoctorServer(t *testing.T, responses map[string]string) *httptest.Server {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		resp, ok := responses[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		status, body, _ := strings.Cut(resp, " ")
+		code, _ := strconv.Atoi(status)
+		w.WriteHeader(code)
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestRunDoctor(t *testing.T) {
+	t.Parallel()
+
+	gluetunOK := map[string]string{
+		"/v1/openvpn/portforwarded": `200 {"port":51413}`,
+		"/v1/openvpn/status":        `200 {"status":"running"}`,
+	}
+	qbitOK := map[string]string{
+		"/api/v2/auth/login":      "200 Ok.",
+		"/api/v2/app/version":     "200 v4.6.0",
+		"/api/v2/app/preferences": `200 {"listen_port":51413}`,
+	}
+	with := func(responses map[string]string, path, resp string) map[string]string {
+		changed := map[string]string{path: resp}
+		for k, v := range responses {
+			if k != path {
+				changed[k] = v
+			}
+		}
+		return changed
+	}
+
+	tt := []struct {
+		name     string
+		gluetun  map[string]string
+		qbit     map[string]string
+		wantCode int
+		want     []string
+	}{
+		{
+			name:    "all good",
+			gluetun: gluetunOK,
+			qbit:    qbitOK,
+			want: []string{
+				"[ OK ] gluetun: VPN status: running",
+				"[ OK ] port sources: port: 51413 from gluetun-api",
+				"[ OK ] qbittorrent: version: v4.6.0",
+				"[ OK ] qbittorrent: preferences: listening on port 51413",
+			},
+		},
+		{
+			name:     "gluetun auth",
+			gluetun:  with(gluetunOK, "/v1/openvpn/portforwarded", "401 Unauthorized"),
+			qbit:     qbitOK,
+			wantCode: exitFailed,
+			want: []string{
+				"[FAIL] gluetun: port forwarding route: bad response: 401 Unauthorized",
+				"hint: gluetun's control server requires authentication for GET /v1/openvpn/portforwarded",
+				"[SKIP] gluetun: VPN status",
+			},
+		},
+		{
+			name:     "VPN stopped",
+			gluetun:  with(gluetunOK, "/v1/openvpn/status", `200 {"status":"stopped"}`),
+			qbit:     qbitOK,
+			wantCode: exitFailed,
+			want:     []string{"[FAIL] gluetun: VPN status: VPN is stopped"},
+		},
+		{
+			name:     "no port yet",
+			gluetun:  with(gluetunOK, "/v1/openvpn/portforwarded", `200 {"port":0}`),
+			qbit:     qbitOK,
+			wantCode: exitFailed,
+			want:     []string{"[FAIL] port sources: port", "VPN_PORT_FORWARDING=on"},
+		},
+		{
+			name:     "host header rejected",
+			gluetun:  gluetunOK,
+			qbit:     with(qbitOK, "/api/v2/app/version", "401 Unauthorized"),
+			wantCode: exitFailed,
+			want:     []string{"[FAIL] qbittorrent: version", "Server domains", "[SKIP] qbittorrent: login"},
+		},
+		{
+			name:    "login needed for version",
+			gluetun: gluetunOK,
+			qbit:    with(qbitOK, "/api/v2/app/version", "403 Forbidden"),
+			want:    []string{"[ OK ] qbittorrent: version: WebUI answered, the version needs a login"},
+		},
+		{
+			name:     "bad credentials",
+			gluetun:  gluetunOK,
+			qbit:     with(qbitOK, "/api/v2/auth/login", "200 Fails."),
+			wantCode: exitFailed,
+			want:     []string{"[FAIL] qbittorrent: login: login failed", "wrong username or password", "[SKIP] qbittorrent: preferences"},
+		},
+		{
+			name:     "banned",
+			gluetun:  gluetunOK,
+			qbit:     with(qbitOK, "/api/v2/auth/login", "403 Banned"),
+			wantCode: exitFailed,
+			want:     []string{"[FAIL] qbittorrent: login: bad response: 403 Forbidden", "banned this IP"},
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			config := Config{
+				GlueTunUrl: startDoctorServer(t, tc.gluetun).URL,
+				QbitUrl:    startDoctorServer(t, tc.qbit).URL,
+				MinPort:    defaultMinPort,
+				MaxPort:    defaultMaxPort,
+			}
+			var out bytes.Buffer
+			if code := runDoctor(&out, config); code != tc.wantCode {
+				t.Errorf("Expected exit code %d, got %d", tc.wantCode, code)
+			}
+			for _, want := range tc.want {
+				if !strings.Contains(out.String(), want) {
+					t.Errorf("Expected the report to contain %q, got:\n%s", want, out.String())
+				}
+			}
+		})
+	}
+}
+
+func TestConnectHostRefused(t *testing.T) {
+	t.Parallel()
+
+	s := httptest.NewServer(http.NotFoundHandler())
+	url := s.URL
+	s.Close()
+	_, err := connectHost(context.Background(), url, "qbittorrent", 8080, "Options > WebUI > Port in qBittorrent")
+	if err == nil || !strings.Contains(withHintText(err), "nothing listens on") {
+		t.Errorf("Expected a hint that nothing listens, got %v", err)
+	}
+}
+
+func withHintText(err error) string {
+	if h, ok := err.(*hintError); ok {
+		return h.hint
+	}
+	return ""
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// EventType is the kind of an Event.
+type EventType string
+
+// Event types, as used in the events of notifiers.
+const (
+	EventPortChanged EventType = "port_changed" // a target was set to a new port
+	EventSyncFailed  EventType = "sync_failed"  // syncing a target failed --notifyfailures times in a row
+	EventForwardLost EventType = "forward_lost" // no port is forwarded anymore
+	EventRecovered   EventType = "recovered"    // a target synced again, or a port is forwarded again
+)
+
+// eventTypes lists every event type, for validation.
+var eventTypes = []EventType{EventPortChanged, EventSyncFailed, EventForwardLost, EventRecovered}
+
+// Event is something that happened while syncing the port, sent to notifiers.
+type Event struct {
+	Type EventType `json:"type"`
+	// Target is the name of the target, empty for forward_lost and the
+	// recovered event that follows it.
+	Target       string    `json:"target,omitempty"`
+	Port         int       `json:"port,omitempty"`
+	PreviousPort int       `json:"previous_port,omitempty"`
+	Source       string    `json:"source,omitempty"`
+	Failures     int       `json:"failures,omitempty"`
+	Error        string    `json:"error,omitempty"`
+	Message      string    `json:"message"`
+	Time         time.Time `json:"time"`
+	// Suppressed is how many sync_failed events of the same target were
+	// held by rate limiting and replaced by a newer one since the last one was sent.
+	Suppressed int `json:"suppressed,omitempty"`
+}
+
+// syncResult is the result of syncing a target once.
+type syncResult struct {
+	target  string
+	port    int
+	changed bool // the port was set, qbittorrent did not listen on it already
+	err     error
+}
+
+// eventTracker turns the results of updates into events. Events are only
+// emitted when something changes, e.g. once when a target starts failing and
+// once when it recovers, so that an outage does not send an event per update.
+type eventTracker struct {
+	notify    *dispatcher
+	hooks     *hookRunner
+	templates *templateRenderer
+	history   *historyRecorder
+
+	forwarded []int           // last forwarded ports set in a target, passed to hooks
+	ports     map[string]int  // last port set or verified in every target
+	failures  map[string]int  // failed syncs in a row of every target
+	failed    map[string]bool // targets with a sync_failed event not followed by recovered
+	lost      bool            // forward_lost was emitted and not followed by recovered
+}
+
+// newEventTracker returns a tracker that knows the ports of state, so that
+// a port change across restarts is still an event.
+func newEventTracker(state State) *eventTracker {
+	hooks := &hookRunner{}
+	t := &eventTracker{
+		notify:    &dispatcher{},
+		hooks:     hooks,
+		templates: &templateRenderer{hooks: hooks},
+		history:   newHistoryRecorder(state),
+		forwarded: state.Ports,
+		ports:     make(map[string]int),
+		failures:  make(map[string]int),
+		failed:    make(map[string]bool),
+	}
+	for name, target := range state.Targets {
+		if target.Port != 0 {
+			t.ports[name] = target.Port
+		}
+	}
+	return t
+}
+
+// observe emits the events of the results of an update, renders the
+// templates, writes the active port and the history, and runs the hooks if the
+// forwarded ports changed and were set in at least one target. Observed are
+// the ports read from the port sources, which may not be stable yet, for the
+// history. Dry runs change nothing and emit no events.
+func (t *eventTracker) observe(config Config, results []syncResult, ports, observed []int, source string, now time.Time) {
+	t.templates.render(config, ports, source, now)
+	if config.DryRun {
+		return
+	}
+	writeActivePort(config, results, ports, source)
+	t.history.observe(config, results, observed, source, now)
+	for _, e := range t.events(config, results, source, now) {
+		t.notify.dispatch(config, e)
+	}
+	if t.syncedPort(results) != 0 && !equalPorts(ports, t.forwarded) {
+		t.hooks.run(config, newPortChange(t.forwarded, ports, source, results, now))
+		t.forwarded = ports
+	}
+}
+
+// events returns the events of the results of an update.
+func (t *eventTracker) events(config Config, results []syncResult, source string, now time.Time) []Event {
+	var events []Event
+	synced := false
+	var noPort error
+	for _, r := range results {
+		switch {
+		case r.err == nil:
+			synced = true
+			previous := t.ports[r.target]
+			if previous != 0 && previous != r.port {
+				events = append(events, Event{
+					Type: EventPortChanged, Target: r.target, Port: r.port, PreviousPort: previous, Source: source,
+					Message: fmt.Sprintf("%s: port changed from %d to %d", r.target, previous, r.port),
+				})
+			}
+			if t.failed[r.target] {
+				events = append(events, Event{
+					Type: EventRecovered, Target: r.target, Port: r.port, Source: source, Failures: t.failures[r.target],
+					Message: fmt.Sprintf("%s: synced again on port %d after %d failures", r.target, r.port, t.failures[r.target]),
+				})
+			}
+			t.ports[r.target] = r.port
+			t.failures[r.target] = 0
+			t.failed[r.target] = false
+		case errors.Is(r.err, ErrNoPort):
+			noPort = r.err
+		case errors.Is(r.err, ErrDryRun):
+		default:
+			t.failures[r.target]++
+			if t.failures[r.target] == config.NotifyFailures {
+				t.failed[r.target] = true
+				events = append(events, Event{
+					Type: EventSyncFailed, Target: r.target, Failures: t.failures[r.target], Error: r.err.Error(),
+					Message: fmt.Sprintf("%s: sync failed %d times in a row: %s", r.target, t.failures[r.target], r.err),
+				})
+			}
+		}
+	}
+	switch {
+	case noPort != nil && !t.lost && len(t.ports) > 0:
+		// only once a port was forwarded, not while gluetun starts up
+		t.lost = true
+		events = append(events, Event{
+			Type: EventForwardLost, Error: noPort.Error(),
+			Message: fmt.Sprintf("No port is forwarded anymore: %s", noPort),
+		})
+	case noPort == nil && synced && t.lost:
+		t.lost = false
+		port := t.syncedPort(results)
+		events = append(events, Event{
+			Type: EventRecovered, Port: port, Source: source,
+			Message: fmt.Sprintf("Port %d is forwarded again", port),
+		})
+	}
+	for i := range events {
+		events[i].Time = now
+	}
+	return events
+}
+
+// syncedPort returns the port of the first target that synced.
+func (t *eventTracker) syncedPort(results []syncResult) int {
+	for _, r := range results {
+		if r.err == nil {
+			return r.port
+		}
+	}
+	return 0
+}
+
+// wait waits until every event was handled and every hook finished,
+// before the program exits.
+func (t *eventTracker) wait() {
+	t.notify.wait()
+	t.hooks.wait()
+}
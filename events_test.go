@@ -0,0 +1,70 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestEventTracker(t *testing.T) {
+	t.Parallel()
+
+	failed := errors.New("connection refused")
+	noPort := fmt.Errorf("%w: gluetun is down", ErrNoPort)
+	config := Config{NotifyFailures: 2}
+	tracker := newEventTracker(State{Targets: map[string]TargetState{"qbittorrent": {Port: 51413}}})
+
+	// every update and the events it should emit
+	updates := []struct {
+		results []syncResult
+		want    []EventType
+	}{
+		// the port of the state is known, so a new port is a change
+		{results: []syncResult{{target: "qbittorrent", port: 51413}}},
+		{results: []syncResult{{target: "qbittorrent", port: 52000}}, want: []EventType{EventPortChanged}},
+		// failures are only sent once, after --notifyfailures in a row
+		{results: []syncResult{{target: "qbittorrent", err: failed}}},
+		{results: []syncResult{{target: "qbittorrent", err: failed}}, want: []EventType{EventSyncFailed}},
+		{results: []syncResult{{target: "qbittorrent", err: failed}}},
+		{results: []syncResult{{target: "qbittorrent", port: 52000}}, want: []EventType{EventRecovered}},
+		// a lost forward is sent once, then its recovery with the new port
+		{results: []syncResult{{target: "qbittorrent", err: noPort}}, want: []EventType{EventForwardLost}},
+		{results: []syncResult{{target: "qbittorrent", err: noPort}}},
+		{results: []syncResult{{target: "qbittorrent", port: 53000}}, want: []EventType{EventPortChanged, EventRecovered}},
+		// a single failure is not sent
+		{results: []syncResult{{target: "qbittorrent", err: failed}}},
+		{results: []syncResult{{target: "qbittorrent", port: 53000}}},
+	}
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	for i, u := range updates {
+		events := tracker.events(config, u.results, "gluetun-api", now)
+		if len(events) != len(u.want) {
+			t.Fatalf("update %d: expected events %v, got %+v", i, u.want, events)
+		}
+		for j, e := range events {
+			if e.Type != u.want[j] {
+				t.Errorf("update %d: expected event %s, got %+v", i, u.want[j], e)
+			}
+			if !e.Time.Equal(now) {
+				t.Errorf("update %d: expected time %s, got %s", i, now, e.Time)
+			}
+		}
+	}
+}
+
+func TestEventTrackerStartup(t *testing.T) {
+	t.Parallel()
+
+	// while gluetun starts up, no port was ever forwarded, so nothing was lost
+	tracker := newEventTracker(State{})
+	events := tracker.events(Config{NotifyFailures: 3}, []syncResult{{target: "qbittorrent", err: ErrNoPort}}, "", time.Now())
+	if len(events) != 0 {
+		t.Errorf("Expected no events, got %+v", events)
+	}
+	// the first port is not a change
+	events = tracker.events(Config{NotifyFailures: 3}, []syncResult{{target: "qbittorrent", port: 51413}}, "", time.Now())
+	if len(events) != 0 {
+		t.Errorf("Expected no events, got %+v", events)
+	}
+}
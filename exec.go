@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// maxStderr is the most output of a failed command included in its error.
+const maxStderr = 512
+
+// execSource gets the forwarded port from the output of a command,
+// so that any VPN tooling can provide the port.
+type execSource struct{}
+
+// Port runs the command and parses the port from its output.
+// The command is killed when ctx is done. A non-zero exit status is an error.
+func (execSource) Port(ctx context.Context, config Config, _ HttpDoer) (int, error) {
+	args := config.execCommand()
+	if len(args) == 0 {
+		return 0, errors.New("no command")
+	}
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Env = append(os.Environ(), config.execEnv()...)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		output := strings.TrimSpace(stderr.String())
+		if len(output) > maxStderr {
+			output = output[:maxStderr] + "..."
+		}
+		if output == "" {
+			return 0, fmt.Errorf("command failed: %w", err)
+		}
+		return 0, fmt.Errorf("command failed: %w: %s", err, output)
+	}
+	return parseCommandPort(stdout.Bytes(), config.ExecField)
+}
+
+// checkExec reports problems with the exec settings.
+func checkExec(c Config) error {
+	if len(c.execCommand()) == 0 {
+		return errors.New("needs --execcommand")
+	}
+	return nil
+}
+
+// execCommand returns the command and its arguments.
+// --execcommand is split on whitespace; use the config file for arguments with spaces.
+func (c Config) execCommand() []string {
+	if c.ExecCommand != "" {
+		return strings.Fields(c.ExecCommand)
+	}
+	return c.ExecArgs
+}
+
+// execEnv returns the extra environment of the command as KEY=VALUE pairs.
+func (c Config) execEnv() []string {
+	env := make([]string, 0, len(c.ExecEnv))
+	for k, v := range c.ExecEnv {
+		env = append(env, k+"="+v)
+	}
+	sort.Strings(env)
+	return env
+}
+
+// parseCommandPort parses the port from the output of a command.
+// If field is empty the output must be a plain integer; otherwise it must be a
+// JSON object and the port is read from field, using dots for nested objects.
+func parseCommandPort(output []byte, field string) (int, error) {
+	if field == "" {
+		port, err := strconv.Atoi(string(bytes.TrimSpace(output)))
+		if err != nil {
+			return 0, fmt.Errorf("output is not a port: %w", err)
+		}
+		return port, nil
+	}
+	var value any
+	if err := json.Unmarshal(output, &value); err != nil {
+		return 0, fmt.Errorf("output is not JSON: %w", err)
+	}
+	for _, key := range strings.Split(field, ".") {
+		object, ok := value.(map[string]any)
+		if !ok {
+			return 0, fmt.Errorf("field %q not found in output", field)
+		}
+		if value, ok = object[key]; !ok {
+			return 0, fmt.Errorf("field %q not found in output", field)
+		}
+	}
+	switch v := value.(type) {
+	case float64:
+		if v != float64(int(v)) {
+			return 0, fmt.Errorf("field %q is not a port: %v", field, v)
+		}
+		return int(v), nil
+	case string:
+		port, err := strconv.Atoi(v)
+		if err != nil {
+			return 0, fmt.Errorf("field %q is not a port: %w", field, err)
+		}
+		return port, nil
+	default:
+		return 0, fmt.Errorf("field %q is not a port: %v", field, v)
+	}
+}
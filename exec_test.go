@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestParseCommandPort(t *testing.T) {
+	t.Parallel()
+
+	tt := []struct {
+		name     string
+		output   string
+		field    string
+		wantPort int
+		wantErr  bool
+	}{
+		{name: "plain", output: "12345\n", wantPort: 12345},
+		{name: "not a number", output: "port 12345", wantErr: true},
+		{name: "json number", output: `{"data": {"port": 12345}}`, field: "data.port", wantPort: 12345},
+		{name: "json string", output: `{"port": "12345"}`, field: "port", wantPort: 12345},
+		{name: "missing field", output: `{"data": {}}`, field: "data.port", wantErr: true},
+		{name: "not an object", output: `{"data": 1}`, field: "data.port", wantErr: true},
+		{name: "not json", output: "12345", field: "port", wantErr: true},
+		{name: "fraction", output: `{"port": 1.5}`, field: "port", wantErr: true},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			port, err := parseCommandPort([]byte(tc.output), tc.field)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("Expected error, got port %d", port)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if port != tc.wantPort {
+				t.Errorf("Expected port %d, got %d", tc.wantPort, port)
+			}
+		})
+	}
+}
+
+func TestExecSource(t *testing.T) {
+	t.Parallel()
+
+	tt := []struct {
+		name     string
+		config   Config
+		wantPort int
+		wantErr  string
+	}{
+		{
+			name:     "plain output",
+			config:   Config{ExecCommand: "echo 12345"},
+			wantPort: 12345,
+		},
+		{
+			name: "json field and env",
+			config: Config{
+				ExecArgs:  []string{"sh", "-c", `echo "{\"port\": $PORT}"`},
+				ExecField: "port",
+				ExecEnv:   map[string]string{"PORT": "23456"},
+			},
+			wantPort: 23456,
+		},
+		{
+			name:    "failed command",
+			config:  Config{ExecArgs: []string{"sh", "-c", "echo no tunnel >&2; exit 3"}},
+			wantErr: "no tunnel",
+		},
+		{
+			name:    "timeout",
+			config:  Config{ExecCommand: "sleep 5", Sources: "exec:50ms"},
+			wantErr: "timed out",
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			chain := &sourceChain{}
+			config := tc.config
+			if config.Sources == "" {
+				config.Sources = "exec"
+			}
+			port, err := chain.GetGlueTunPort(config, http.DefaultClient)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("Expected error containing %q, got %v", tc.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if port != tc.wantPort {
+				t.Errorf("Expected port %d, got %d", tc.wantPort, port)
+			}
+		})
+	}
+
+	// a missing command is an error, not a panic
+	if _, err := (execSource{}).Port(context.Background(), Config{}, nil); err == nil {
+		t.Error("Expected error, got nil")
+	}
+}
@@ -1,75 +1,222 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"os"
-	"time"
+	"strconv"
+	"strings"
+	"sync"
 )
 
-type glueGetter struct {
+// gluetunApiSource gets the forwarded port from gluetun's control server.
+type gluetunApiSource struct {
+	clients gluetunClients
 }
 
-func (g glueGetter) GetGlueTunPort(config Config, requester HttpDoer) (int, error) {
-	return getPort(config, requester)
+func (s *gluetunApiSource) Port(ctx context.Context, config Config, client HttpDoer) (int, error) {
+	return firstPort(s.Ports(ctx, config, client))
+}
+
+// Ports returns every port forwarded by gluetun.
+func (s *gluetunApiSource) Ports(ctx context.Context, config Config, client HttpDoer) ([]int, error) {
+	gluetun, err := s.clients.get(config, client)
+	if err != nil {
+		return nil, err
+	}
+	return getPortsApi(ctx, config.gluetunUrl(), gluetun)
+}
+
+// checkGluetunApi reports problems with the settings of the gluetun api.
+func checkGluetunApi(c Config) error {
+	var errs []error
+	if c.GlueTunUrl == "" && (c.GlueTunHost == "" || c.GlueTunPort == 0) {
+		errs = append(errs, errors.New("needs --gluetunurl or --gluetunhost and --gluetunport"))
+	}
+	if c.GlueTunUrl != "" {
+		if err := checkUrl(c.GlueTunUrl); err != nil {
+			errs = append(errs, fmt.Errorf("--gluetunurl: %w", err))
+		}
+	}
+	if c.GlueTunPort < 0 || c.GlueTunPort > 65535 {
+		errs = append(errs, fmt.Errorf("--gluetunport %d is not a valid port", c.GlueTunPort))
+	}
+	if _, err := c.gluetunTLS().tlsConfig(); err != nil {
+		errs = append(errs, fmt.Errorf("TLS: %w", err))
+	}
+	return errors.Join(errs...)
+}
+
+// gluetunFileSource gets the forwarded port from the file written by gluetun.
+type gluetunFileSource struct{}
+
+func (gluetunFileSource) Port(_ context.Context, config Config, _ HttpDoer) (int, error) {
+	return getPortFile(config.GlueTunPortFile)
+}
+
+// Ports returns every port listed in the gluetun port file.
+func (gluetunFileSource) Ports(_ context.Context, config Config, _ HttpDoer) ([]int, error) {
+	return getPortsFile(config.GlueTunPortFile)
 }
 
 func decodeGlueTunPort(toRead io.Reader) (int, error) {
+	return firstPort(decodeGlueTunPorts(toRead))
+}
+
+// decodeGlueTunPorts decodes the forwarded ports from gluetun, either a JSON
+// object with a port or a list of ports, or ports separated by whitespace
+// as written to the port file by newer versions of gluetun.
+func decodeGlueTunPorts(toRead io.Reader) ([]int, error) {
+	b, err := io.ReadAll(toRead)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(bytes.TrimSpace(b), []byte("{")) {
+		var ports []int
+		for _, field := range strings.Fields(string(b)) {
+			p, err := strconv.Atoi(field)
+			if err != nil {
+				return nil, fmt.Errorf("cannot decode forwarded ports: %w", err)
+			}
+			ports = append(ports, p)
+		}
+		return ports, nil
+	}
 	var portFile port
-	decoder := json.NewDecoder(toRead)
-	err := decoder.Decode(&portFile)
-	return portFile.Port, err
+	if err := json.Unmarshal(b, &portFile); err != nil {
+		return nil, err
+	}
+	if len(portFile.Ports) > 0 {
+		return portFile.Ports, nil
+	}
+	return []int{portFile.Port}, nil
+}
+
+// firstPort returns the first of ports, for sources that return several.
+func firstPort(ports []int, err error) (int, error) {
+	if err != nil {
+		return 0, err
+	}
+	if len(ports) == 0 {
+		return 0, ErrNoPort
+	}
+	return ports[0], nil
 }
 
 // getPortFile returns the forwarded port from a file written by gluetun.
 func getPortFile(path string) (int, error) {
+	return firstPort(getPortsFile(path))
+}
+
+// getPortsFile returns the forwarded ports from a file written by gluetun.
+func getPortsFile(path string) ([]int, error) {
 	file, err := os.Open(path)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
 	defer file.Close()
-	return decodeGlueTunPort(file)
+	return decodeGlueTunPorts(file)
 }
 
 // getPortApi returns the forwarded port from gluetun's api.
-func getPortApi(url string, client HttpDoer) (int, error) {
-	url = url + "/v1/openvpn/portforwarded"
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*1)
-	defer cancel()
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+func getPortApi(ctx context.Context, baseUrl string, client HttpDoer) (int, error) {
+	return firstPort(getPortsApi(ctx, baseUrl, client))
+}
+
+// getPortsApi returns the forwarded ports from gluetun's api.
+func getPortsApi(ctx context.Context, baseUrl string, client HttpDoer) ([]int, error) {
+	endpoint, err := url.JoinPath(baseUrl, "v1/openvpn/portforwarded")
 	if err != nil {
-		return 0, err
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, err
 	}
 	resp, err := client.Do(req)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
 	defer resp.Body.Close()
-	return decodeGlueTunPort(resp.Body)
+	return decodeGlueTunPorts(resp.Body)
 }
 
-// getPort returns the forwarded port from gluetun.
-func getPort(config Config, client HttpDoer) (int, error) {
-	var port int
-	var apiErr error
-	var fileErr error
-
-	if config.GlueTunPort != 0 {
-		port, apiErr = getPortApi(config.gluetunUrl(), client)
-		if apiErr == nil {
-			return port, nil
-		}
+// gluetunGet gets path from gluetun's control server and decodes the JSON response into v.
+func gluetunGet(ctx context.Context, client HttpDoer, baseUrl string, path string, v any) error {
+	endpoint, err := url.JoinPath(baseUrl, path)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return httpHint(err, "gluetun")
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return withHint(&StatusError{StatusCode: resp.StatusCode, Status: resp.Status},
+			"gluetun's control server requires authentication for GET /%s. Allow the route without authentication in gluetun's auth config (/gluetun/auth/config.toml), in a role with auth = \"none\"", path)
+	case http.StatusNotFound:
+		return withHint(&StatusError{StatusCode: resp.StatusCode, Status: resp.Status},
+			"%s is not gluetun's control server, check the port and path of --gluetunurl", baseUrl)
+	default:
+		return &StatusError{StatusCode: resp.StatusCode, Status: resp.Status}
 	}
-	if config.GlueTunPortFile == "" {
-		return 0, apiErr
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("cannot decode the response of %s: %w", endpoint, err)
 	}
-	port, fileErr = getPortFile(config.GlueTunPortFile)
-	if fileErr == nil {
-		return port, nil
+	return nil
+}
+
+// gluetunClient returns the client to reach the gluetun api with.
+// Gluetun gets its own client when it is reached over https or has TLS
+// options, so that the TLS settings of qbittorrent are not used for gluetun.
+func gluetunClient(config Config, client HttpDoer) (HttpDoer, error) {
+	if !ownGluetunClient(config) {
+		return client, nil
 	}
+	return newHttpClient(config.gluetunTLS())
+}
 
-	return 0, errors.Join(apiErr, fileErr)
+// ownGluetunClient reports whether gluetun needs its own client, see gluetunClient.
+func ownGluetunClient(config Config) bool {
+	return !config.gluetunTLS().isZero() || strings.HasPrefix(config.gluetunUrl(), "https://")
+}
+
+// gluetunClients keeps the client of gluetunClient, so that its connections
+// are reused across updates. It is created again when the TLS options change.
+type gluetunClients struct {
+	mu     sync.Mutex
+	key    string
+	client HttpDoer
+}
+
+// get returns the client to reach the gluetun api with, see gluetunClient.
+func (c *gluetunClients) get(config Config, client HttpDoer) (HttpDoer, error) {
+	if !ownGluetunClient(config) {
+		return client, nil
+	}
+	key := fmt.Sprintf("%+v", config.gluetunTLS())
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.client != nil && c.key == key {
+		return c.client, nil
+	}
+	gluetun, err := newHttpClient(config.gluetunTLS())
+	if err != nil {
+		return nil, err
+	}
+	c.key, c.client = key, gluetun
+	return gluetun, nil
 }
@@ -2,12 +2,14 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"reflect"
 	"strings"
 	"testing"
 )
@@ -103,6 +105,39 @@ func TestDecodeGlueTunPort(t *testing.T) {
 	}
 }
 
+func TestDecodeGlueTunPorts(t *testing.T) {
+	t.Parallel()
+
+	tt := []struct {
+		name     string
+		portFile string
+		expected []int
+		hasErr   bool
+	}{
+		{name: "single port", portFile: `{"port": 12345}`, expected: []int{12345}},
+		{name: "port list", portFile: `{"port": 12345, "ports": [12345, 23456]}`, expected: []int{12345, 23456}},
+		{name: "plain ports", portFile: "12345\n23456\n", expected: []int{12345, 23456}},
+		{name: "invalid", portFile: "12345\nport", hasErr: true},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			ports, err := decodeGlueTunPorts(strings.NewReader(tc.portFile))
+			if tc.hasErr {
+				if err == nil {
+					t.Fatal("Expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(ports, tc.expected) {
+				t.Errorf("Expected ports %v, got %v", tc.expected, ports)
+			}
+		})
+	}
+}
+
 func TestGetPortApi(t *testing.T) {
 	t.Parallel()
 
@@ -145,7 +180,7 @@ func TestGetPortApi(t *testing.T) {
 	}
 	for _, tc := range tt {
 		t.Run(tc.name, func(t *testing.T) {
-			port, err := getPortApi(tc.url, http.DefaultClient)
+			port, err := getPortApi(context.Background(), tc.url, http.DefaultClient)
 			if tc.hasErr && err == nil {
 				t.Error("Expected error, got nil")
 			}
@@ -198,7 +233,7 @@ func TestGetPort(t *testing.T) {
 				body: `{"port": 12345}`,
 			},
 			config: Config{
-				GlueTunHost: "http://localhost",
+				GlueTunHost: "localhost",
 				GlueTunPort: 8000,
 			},
 			wantPort: 12345,
@@ -211,7 +246,7 @@ func TestGetPort(t *testing.T) {
 				body: `{"port": 12345}`,
 			},
 			config: Config{
-				GlueTunHost:     "http://localhost",
+				GlueTunHost:     "localhost",
 				GlueTunPort:     8000,
 				GlueTunPortFile: "",
 			},
@@ -241,7 +276,7 @@ func TestGetPort(t *testing.T) {
 	}
 	for _, tc := range tt {
 		t.Run(tc.name, func(t *testing.T) {
-			g := glueGetter{}
+			g := sourceChain{}
 			port, err := g.GetGlueTunPort(tc.config, &tc.httpDoer)
 			if tc.wantErr && err == nil {
 				t.Error("Expected error, got nil")
@@ -255,3 +290,23 @@ func TestGetPort(t *testing.T) {
 		})
 	}
 }
+
+func TestGetPortApi_BasePath(t *testing.T) {
+	t.Parallel()
+
+	var server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/gluetun/v1/openvpn/portforwarded" {
+			t.Errorf("unexpected request path: %s", r.URL.Path)
+		}
+		w.Write([]byte(`{"port": 12345}`))
+	}))
+	defer server.Close()
+
+	port, err := getPortApi(context.Background(), server.URL+"/gluetun/", http.DefaultClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if port != 12345 {
+		t.Errorf("Expected port %d, got %d", 12345, port)
+	}
+}
@@ -3,9 +3,11 @@ module gluebit
 go 1.20
 
 require (
+	github.com/BurntSushi/toml v1.6.0
 	github.com/alexflint/go-arg v1.4.3
 	github.com/pkg/errors v0.9.1
 	golang.org/x/net v0.14.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
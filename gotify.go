@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+)
+
+// gotifyPriorities maps priorities from 1 to 5 to gotify's, from 0 to 10.
+// Gotify clients show 4 to 7 with a sound and 8 and above as a popup.
+var gotifyPriorities = map[int]int{1: 1, 2: 2, 3: 5, 4: 8, 5: 10}
+
+// gotify sends events as messages to a gotify server with an application token.
+type gotify struct {
+	spec   NotifierSpec
+	client HttpDoer
+}
+
+func newGotify(spec NotifierSpec) Notifier {
+	return gotify{spec: spec, client: http.DefaultClient}
+}
+
+// checkGotify reports problems with the settings of gotify.
+func checkGotify(spec NotifierSpec) error {
+	var errs []error
+	if err := checkNotifyUrl(spec); err != nil {
+		errs = append(errs, err)
+	}
+	if spec.Token == "" {
+		errs = append(errs, errors.New("needs the token of a gotify application"))
+	}
+	return errors.Join(errs...)
+}
+
+func (g gotify) Notify(ctx context.Context, event Event) error {
+	endpoint, err := url.JoinPath(g.spec.URL, "message")
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(map[string]any{
+		"title":    title(event),
+		"message":  event.Message,
+		"priority": gotifyPriorities[g.spec.priority(event.Type)],
+	})
+	if err != nil {
+		return err
+	}
+	req, err := newNotifyRequest(ctx, g.spec, endpoint, "application/json", body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Gotify-Key", g.spec.Token)
+	return postNotification(g.client, req)
+}
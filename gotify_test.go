@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestGotify(t *testing.T) {
+	t.Parallel()
+
+	tt := []struct {
+		event        Event
+		wantPriority int
+	}{
+		{event: Event{Type: EventPortChanged, Message: "qbittorrent: port changed from 51413 to 52000"}, wantPriority: 5},
+		{event: Event{Type: EventSyncFailed, Message: "qbittorrent: sync failed 3 times in a row"}, wantPriority: 8},
+	}
+	for _, tc := range tt {
+		t.Run(string(tc.event.Type), func(t *testing.T) {
+			server := startNotifyServer(t, 200)
+			spec := NotifierSpec{URL: server.URL + "/gotify/", Token: "app-token"}
+			if err := newGotify(spec).Notify(context.Background(), tc.event); err != nil {
+				t.Fatal(err)
+			}
+			requests, bodies := server.received()
+			if len(requests) != 1 {
+				t.Fatalf("Expected 1 request, got %d", len(requests))
+			}
+			if requests[0].URL.Path != "/gotify/message" {
+				t.Errorf("Expected path /gotify/message, got %s", requests[0].URL.Path)
+			}
+			if got := requests[0].Header.Get("X-Gotify-Key"); got != "app-token" {
+				t.Errorf("Expected the token in X-Gotify-Key, got %q", got)
+			}
+			var msg struct {
+				Title    string `json:"title"`
+				Message  string `json:"message"`
+				Priority int    `json:"priority"`
+			}
+			if err := json.Unmarshal([]byte(bodies[0]), &msg); err != nil {
+				t.Fatal(err)
+			}
+			if msg.Title != title(tc.event) || msg.Message != tc.event.Message || msg.Priority != tc.wantPriority {
+				t.Errorf("Expected %q, %q and priority %d, got %+v", title(tc.event), tc.event.Message, tc.wantPriority, msg)
+			}
+		})
+	}
+}
+
+func TestCheckGotify(t *testing.T) {
+	t.Parallel()
+
+	err := checkGotify(NotifierSpec{URL: "https://gotify.lan"})
+	if err == nil || !strings.Contains(err.Error(), "needs the token") {
+		t.Errorf("Expected a missing token error, got %v", err)
+	}
+	if err := checkGotify(NotifierSpec{URL: "https://gotify.lan", Token: "app-token"}); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+}
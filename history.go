@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Types of history records.
+const (
+	HistoryObserved  = "observed"  // the port sources forward new ports, stable or not
+	HistoryApplied   = "applied"   // a target was set to a new port
+	HistoryVerified  = "verified"  // a target was found on a port gluebit did not know of, e.g. after a restart
+	HistoryFailed    = "failed"    // syncing a target started failing
+	HistoryLost      = "lost"      // no port is forwarded anymore, after a port was set
+	HistoryRecovered = "recovered" // a target synced again, or a port is forwarded again
+)
+
+// historyTypes lists every type of history record, for validation.
+var historyTypes = []string{HistoryObserved, HistoryApplied, HistoryVerified, HistoryFailed, HistoryLost, HistoryRecovered}
+
+// HistoryRecord is a line of the history file.
+type HistoryRecord struct {
+	Time time.Time `json:"time"`
+	Type string    `json:"type"`
+	// Target is the name of the target, empty for observed, lost and the
+	// recovered record that follows lost.
+	Target       string `json:"target,omitempty"`
+	Port         int    `json:"port,omitempty"`
+	PreviousPort int    `json:"previous_port,omitempty"`
+	Ports        []int  `json:"ports,omitempty"`
+	Source       string `json:"source,omitempty"`
+	Error        string `json:"error,omitempty"`
+	// Failures is how many syncs failed in a row before a target recovered.
+	Failures int `json:"failures,omitempty"`
+}
+
+// String formats the record for "gluebit history".
+func (r HistoryRecord) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %-9s ", r.Time.Format(time.RFC3339), r.Type)
+	if r.Target != "" {
+		fmt.Fprintf(&b, "%s: ", r.Target)
+	}
+	switch r.Type {
+	case HistoryObserved:
+		fmt.Fprintf(&b, "ports %s", formatPorts(r.Ports))
+	case HistoryApplied, HistoryVerified:
+		fmt.Fprintf(&b, "port %d", r.Port)
+		if r.PreviousPort != 0 {
+			fmt.Fprintf(&b, ", was %d", r.PreviousPort)
+		}
+	case HistoryFailed, HistoryLost:
+		b.WriteString(r.Error)
+	case HistoryRecovered:
+		fmt.Fprintf(&b, "port %d", r.Port)
+		if r.Failures > 0 {
+			fmt.Fprintf(&b, " after %d failures", r.Failures)
+		}
+	}
+	if r.Source != "" {
+		fmt.Fprintf(&b, " from %s", r.Source)
+	}
+	return b.String()
+}
+
+// historyRecorder turns the results of updates into history records.
+// Like events, records are only written when something changes.
+type historyRecorder struct {
+	observed []int          // last ports read from the port sources
+	ports    map[string]int // last port set or verified in every target
+	failures map[string]int // failed syncs in a row of every target
+	lost     bool           // lost was recorded and not followed by recovered
+}
+
+// newHistoryRecorder returns a recorder that knows the ports of state, so
+// that a restart does not record them again.
+func newHistoryRecorder(state State) *historyRecorder {
+	r := &historyRecorder{observed: state.Ports, ports: make(map[string]int), failures: make(map[string]int)}
+	for name, target := range state.Targets {
+		if target.Port != 0 {
+			r.ports[name] = target.Port
+		}
+	}
+	return r
+}
+
+// observe appends the records of the results of an update to --historyfile.
+// Observed are the ports read from the port sources, stable or not.
+// Failures are only logged, as the history is not needed to sync the port.
+func (h *historyRecorder) observe(config Config, results []syncResult, observed []int, source string, now time.Time) {
+	if config.HistoryFile == "" {
+		return
+	}
+	records := h.records(results, observed, source, now)
+	if len(records) == 0 {
+		return
+	}
+	if err := appendHistory(config, records); err != nil {
+		logger("history").Warn("Failed to write history", "path", config.HistoryFile, "error", err)
+	}
+}
+
+// records returns the history records of the results of an update.
+func (h *historyRecorder) records(results []syncResult, observed []int, source string, now time.Time) []HistoryRecord {
+	var records []HistoryRecord
+	if checkForwardedPorts(observed) == nil && !equalPorts(observed, h.observed) {
+		records = append(records, HistoryRecord{Type: HistoryObserved, Ports: observed, Source: source})
+		h.observed = observed
+	}
+	synced := 0
+	var noPort error
+	for _, r := range results {
+		switch {
+		case r.err == nil:
+			if synced == 0 {
+				synced = r.port
+			}
+			if failures := h.failures[r.target]; failures > 0 {
+				records = append(records, HistoryRecord{Type: HistoryRecovered, Target: r.target, Port: r.port, Source: source, Failures: failures})
+			}
+			// only a port that was set is applied, qbittorrent may have
+			// listened on it before gluebit started
+			switch previous := h.ports[r.target]; {
+			case r.changed:
+				records = append(records, HistoryRecord{Type: HistoryApplied, Target: r.target, Port: r.port, PreviousPort: previous, Source: source})
+			case previous != r.port:
+				records = append(records, HistoryRecord{Type: HistoryVerified, Target: r.target, Port: r.port, PreviousPort: previous, Source: source})
+			}
+			h.ports[r.target] = r.port
+			h.failures[r.target] = 0
+		case errors.Is(r.err, ErrNoPort):
+			noPort = r.err
+		case errors.Is(r.err, ErrDryRun):
+		default:
+			h.failures[r.target]++
+			if h.failures[r.target] == 1 {
+				records = append(records, HistoryRecord{Type: HistoryFailed, Target: r.target, Error: r.err.Error()})
+			}
+		}
+	}
+	switch {
+	case noPort != nil && !h.lost && len(h.ports) > 0:
+		// only once a port was set, not while gluetun starts up
+		h.lost = true
+		h.observed = nil
+		records = append(records, HistoryRecord{Type: HistoryLost, Error: noPort.Error()})
+	case noPort == nil && synced != 0 && h.lost:
+		h.lost = false
+		records = append(records, HistoryRecord{Type: HistoryRecovered, Port: synced, Source: source})
+	}
+	for i := range records {
+		records[i].Time = now
+	}
+	return records
+}
+
+// appendHistory appends records to the history file as JSON lines, rotating
+// it first if they would make it larger than --historymaxsize.
+func appendHistory(config Config, records []HistoryRecord) error {
+	var b []byte
+	for _, r := range records {
+		line, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		b = append(append(b, line...), '\n')
+	}
+	path := config.HistoryFile
+	if info, err := os.Stat(path); err == nil && config.HistoryMaxSize > 0 && info.Size()+int64(len(b)) > int64(config.HistoryMaxSize)<<20 {
+		if err := rotateHistory(path, config.HistoryKeep); err != nil {
+			return fmt.Errorf("rotate: %w", err)
+		}
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// rotateHistory renames path to path.1, path.1 to path.2 and so on,
+// removing the files beyond path.<keep>.
+func rotateHistory(path string, keep int) error {
+	if keep < 1 {
+		return os.Remove(path)
+	}
+	if err := os.Remove(rotatedHistory(path, keep)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	for i := keep - 1; i >= 1; i-- {
+		if err := os.Rename(rotatedHistory(path, i), rotatedHistory(path, i+1)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return os.Rename(path, rotatedHistory(path, 1))
+}
+
+// rotatedHistory returns the path of the n-th rotated history file.
+func rotatedHistory(path string, n int) string {
+	return path + "." + strconv.Itoa(n)
+}
+
+// readHistory calls fn with every record of the history file and the rotated
+// files that are kept, oldest first, until fn returns false.
+func readHistory(path string, keep int, fn func(HistoryRecord) bool) error {
+	var paths []string
+	for i := keep; i >= 1; i-- {
+		paths = append(paths, rotatedHistory(path, i))
+	}
+	paths = append(paths, path)
+	for _, p := range paths {
+		f, err := os.Open(p)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		more, err := readHistoryFile(f, fn)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %w", p, err)
+		}
+		if !more {
+			return nil
+		}
+	}
+	return nil
+}
+
+// readHistoryFile calls fn with every record of r. It reports whether fn
+// wants more records.
+func readHistoryFile(r io.Reader, fn func(HistoryRecord) bool) (bool, error) {
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var record HistoryRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return false, fmt.Errorf("line %d: %w", line, err)
+		}
+		if !fn(record) {
+			return false, nil
+		}
+	}
+	return true, scanner.Err()
+}
+
+// HistoryCmd holds the options of "gluebit history".
+type HistoryCmd struct {
+	Since  string `arg:"--since" help:"only print records from this time on, as RFC 3339, a date such as 2026-10-01 or a duration before now such as 24h or 7d"`
+	Until  string `arg:"--until" help:"only print records before this time, in the same formats as --since"`
+	Type   string `arg:"--type" help:"only print records of this type: observed, applied, verified, failed, lost or recovered"`
+	Target string `arg:"--target" help:"only print records of this target"`
+	JSON   bool   `arg:"--json" help:"print the records as JSON lines"`
+}
+
+// parseHistoryTime parses the --since and --until of "gluebit history".
+// An empty string is the zero time.
+func parseHistoryTime(s string, now time.Time) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		if n, err := strconv.Atoi(days); err == nil && n >= 0 {
+			return now.AddDate(0, 0, -n), nil
+		}
+	}
+	if d, err := time.ParseDuration(s); err == nil && d >= 0 {
+		return now.Add(-d), nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation(time.DateOnly, s, now.Location()); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("%q is not a time such as 2026-10-01T12:00:00Z, 2026-10-01, 24h or 7d", s)
+}
+
+// printHistory implements "gluebit history".
+// It prints the records of the history file in the time range of cmd.
+func printHistory(w io.Writer, config Config, cmd *HistoryCmd, now time.Time) int {
+	if config.HistoryFile == "" {
+		fmt.Fprintln(os.Stderr, "No history is kept, set --historyfile")
+		return exitFailed
+	}
+	since, err := parseHistoryTime(cmd.Since, now)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "--since %s\n", err)
+		return exitFailed
+	}
+	until, err := parseHistoryTime(cmd.Until, now)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "--until %s\n", err)
+		return exitFailed
+	}
+	if cmd.Type != "" && !containsString(historyTypes, cmd.Type) {
+		fmt.Fprintf(os.Stderr, "--type %q must be one of %s\n", cmd.Type, strings.Join(historyTypes, ", "))
+		return exitFailed
+	}
+	enc := json.NewEncoder(w)
+	err = readHistory(config.HistoryFile, config.HistoryKeep, func(r HistoryRecord) bool {
+		switch {
+		case r.Time.Before(since):
+			return true
+		case !until.IsZero() && !r.Time.Before(until):
+			// records are appended in order, so the rest are later
+			return false
+		case cmd.Type != "" && r.Type != cmd.Type:
+		case cmd.Target != "" && r.Target != cmd.Target:
+		case cmd.JSON:
+			enc.Encode(r)
+		default:
+			fmt.Fprintln(w, r)
+		}
+		return true
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFailed
+	}
+	return exitOK
+}
+
+// containsString reports whether list contains s.
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHistoryRecorder(t *testing.T) {
+	t.Parallel()
+
+	recorder := newHistoryRecorder(State{Ports: []int{51413}, Targets: map[string]TargetState{"qbittorrent": {Port: 51413}}})
+	refused := errors.New("connection refused")
+	updates := []struct {
+		ports   []int
+		results []syncResult
+		want    []string
+	}{
+		// the ports of the state are not recorded again
+		{ports: []int{51413}, results: []syncResult{{target: "qbittorrent", port: 51413}}},
+		{ports: []int{52000}, results: []syncResult{{target: "qbittorrent", port: 52000, changed: true}}, want: []string{HistoryObserved, HistoryApplied}},
+		// a target that already listens on a new port is verified, not applied
+		{ports: []int{52000}, results: []syncResult{{target: "seedbox", port: 52000}}, want: []string{HistoryVerified}},
+		{ports: []int{52000}, results: []syncResult{{target: "seedbox", port: 52000}}},
+		{ports: []int{52000}, results: []syncResult{{target: "qbittorrent", err: refused}}, want: []string{HistoryFailed}},
+		// only the first failure in a row is recorded
+		{ports: []int{52000}, results: []syncResult{{target: "qbittorrent", err: refused}}},
+		{ports: []int{52000}, results: []syncResult{{target: "qbittorrent", port: 52000}}, want: []string{HistoryRecovered}},
+		{results: []syncResult{{target: "qbittorrent", err: ErrNoPort}}, want: []string{HistoryLost}},
+		{results: []syncResult{{target: "qbittorrent", err: ErrNoPort}}},
+		{ports: []int{52000}, results: []syncResult{{target: "qbittorrent", port: 52000}}, want: []string{HistoryObserved, HistoryRecovered}},
+	}
+	for i, u := range updates {
+		var types []string
+		for _, r := range recorder.records(u.results, u.ports, "gluetun-api", time.Now()) {
+			types = append(types, r.Type)
+		}
+		if !reflect.DeepEqual(types, u.want) {
+			t.Errorf("Update %d: expected records %v, got %v", i, u.want, types)
+		}
+	}
+}
+
+func TestHistoryRecorderStartup(t *testing.T) {
+	t.Parallel()
+
+	// no port is lost while gluetun starts up
+	recorder := newHistoryRecorder(State{})
+	noPort := []syncResult{{target: "qbittorrent", err: ErrNoPort}}
+	if records := recorder.records(noPort, nil, "", time.Now()); len(records) != 0 {
+		t.Errorf("Expected no records before the first port, got %v", records)
+	}
+	recorder.records([]syncResult{{target: "qbittorrent", port: 51413, changed: true}}, []int{51413}, "gluetun-api", time.Now())
+	if records := recorder.records(noPort, nil, "", time.Now()); len(records) != 1 || records[0].Type != HistoryLost {
+		t.Errorf("Expected the port to be lost, got %v", records)
+	}
+}
+
+func TestAppendHistoryRotation(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "history.jsonl")
+	config := Config{HistoryFile: path, HistoryMaxSize: 1, HistoryKeep: 2}
+	// every batch is about 0.4 MiB, so the file is rotated every other batch
+	record := HistoryRecord{Type: HistoryFailed, Target: "qbittorrent", Error: strings.Repeat("x", 1000)}
+	batch := make([]HistoryRecord, 400)
+	for i := range batch {
+		batch[i] = record
+	}
+	for i := 0; i < 7; i++ {
+		if err := appendHistory(config, batch); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, p := range []string{path, path + ".1", path + ".2"} {
+		info, err := os.Stat(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() > 1<<20 {
+			t.Errorf("Expected %s to be rotated at 1 MiB, it has %d bytes", p, info.Size())
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("Expected only 2 rotated files to be kept, got %v", err)
+	}
+}
+
+func TestPrintHistory(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "history.jsonl")
+	config := Config{HistoryFile: path, HistoryKeep: 1}
+	day := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	rotated := []HistoryRecord{
+		{Time: day, Type: HistoryObserved, Ports: []int{51413}, Source: "gluetun-api"},
+		{Time: day, Type: HistoryApplied, Target: "qbittorrent", Port: 51413, Source: "gluetun-api"},
+	}
+	current := []HistoryRecord{
+		{Time: day.AddDate(0, 0, 2), Type: HistoryFailed, Target: "qbittorrent", Error: "connection refused"},
+		{Time: day.AddDate(0, 0, 3), Type: HistoryRecovered, Target: "qbittorrent", Port: 51413, Failures: 4, Source: "gluetun-api"},
+		{Time: day.AddDate(0, 0, 4), Type: HistoryApplied, Target: "qbittorrent", Port: 52000, PreviousPort: 51413, Source: "gluetun-api"},
+	}
+	if err := appendHistory(Config{HistoryFile: path + ".1"}, rotated); err != nil {
+		t.Fatal(err)
+	}
+	if err := appendHistory(config, current); err != nil {
+		t.Fatal(err)
+	}
+
+	now := day.AddDate(0, 0, 5)
+	tests := []struct {
+		name string
+		cmd  HistoryCmd
+		want string
+	}{
+		{name: "all", want: `2026-10-01T12:00:00Z observed  ports 51413 from gluetun-api
+2026-10-01T12:00:00Z applied   qbittorrent: port 51413 from gluetun-api
+2026-10-03T12:00:00Z failed    qbittorrent: connection refused
+2026-10-04T12:00:00Z recovered qbittorrent: port 51413 after 4 failures from gluetun-api
+2026-10-05T12:00:00Z applied   qbittorrent: port 52000, was 51413 from gluetun-api
+`},
+		{name: "range", cmd: HistoryCmd{Since: "2026-10-02", Until: "48h"}, want: `2026-10-03T12:00:00Z failed    qbittorrent: connection refused
+`},
+		{name: "type", cmd: HistoryCmd{Since: "7d", Type: HistoryApplied, JSON: true}, want: `{"time":"2026-10-01T12:00:00Z","type":"applied","target":"qbittorrent","port":51413,"source":"gluetun-api"}
+{"time":"2026-10-05T12:00:00Z","type":"applied","target":"qbittorrent","port":52000,"previous_port":51413,"source":"gluetun-api"}
+`},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			var b bytes.Buffer
+			if code := printHistory(&b, config, &tt.cmd, now); code != exitOK {
+				t.Fatalf("Expected exit code %d, got %d", exitOK, code)
+			}
+			if b.String() != tt.want {
+				t.Errorf("Expected\n%s\ngot\n%s", tt.want, b.String())
+			}
+		})
+	}
+}
+
+func TestParseHistoryTime(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		in      string
+		want    time.Time
+		wantErr bool
+	}{
+		{in: "", want: time.Time{}},
+		{in: "24h", want: now.Add(-24 * time.Hour)},
+		{in: "7d", want: now.AddDate(0, 0, -7)},
+		{in: "2026-10-01", want: time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)},
+		{in: "2026-10-01T08:00:00+02:00", want: time.Date(2026, 10, 1, 6, 0, 0, 0, time.UTC)},
+		{in: "yesterday", wantErr: true},
+		{in: "-1h", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseHistoryTime(tt.in, now)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%q: unexpected error %v", tt.in, err)
+			continue
+		}
+		if !got.Equal(tt.want) {
+			t.Errorf("%q: expected %s, got %s", tt.in, tt.want, got)
+		}
+	}
+}
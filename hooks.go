@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxHookOutput is the most output of a hook that is logged.
+const maxHookOutput = 64 << 10
+
+// HookSpec configures a command run when the forwarded port changes.
+type HookSpec struct {
+	// Name identifies the hook in logs, the base name of the command by default.
+	Name    string            `yaml:"name" toml:"name"`
+	Command []string          `yaml:"command" toml:"command"`
+	Env     map[string]string `yaml:"env" toml:"env"`
+	// Timeout is how long the hook may run, e.g. 10s, --hooktimeout by default.
+	Timeout string `yaml:"timeout" toml:"timeout"`
+}
+
+// name returns the name of the hook.
+func (h HookSpec) name() string {
+	if h.Name != "" || len(h.Command) == 0 {
+		return h.Name
+	}
+	return filepath.Base(h.Command[0])
+}
+
+// timeout returns how long the hook may run.
+func (h HookSpec) timeout(config Config) time.Duration {
+	if d, err := time.ParseDuration(h.Timeout); err == nil {
+		return d
+	}
+	return time.Duration(config.HookTimeout) * time.Second
+}
+
+// check reports problems with the settings of the hook.
+func (h HookSpec) check() error {
+	var errs []error
+	if len(h.Command) == 0 {
+		errs = append(errs, errors.New("needs a command"))
+	}
+	if h.Timeout != "" {
+		if d, err := time.ParseDuration(h.Timeout); err != nil || d <= 0 {
+			errs = append(errs, fmt.Errorf("timeout %q is not a positive duration", h.Timeout))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// hooks returns the hooks to run: the one of --hookcommand, if set, followed
+// by the hooks of the config file. --hookcommand is split on whitespace.
+func (c Config) hooks() []HookSpec {
+	if c.HookCommand == "" {
+		return c.Hooks
+	}
+	return append([]HookSpec{{Command: strings.Fields(c.HookCommand)}}, c.Hooks...)
+}
+
+// PortChange is passed to hooks as JSON on stdin.
+type PortChange struct {
+	// OldPort and NewPort are the first of OldPorts and Ports.
+	// OldPort is 0 for the first port gluebit sees.
+	OldPort  int            `json:"old_port"`
+	NewPort  int            `json:"new_port"`
+	OldPorts []int          `json:"old_ports"`
+	Ports    []int          `json:"ports"`
+	Source   string         `json:"source,omitempty"`
+	Targets  []TargetResult `json:"targets"`
+	Time     time.Time      `json:"time"`
+}
+
+// TargetResult is the result of syncing a target, as passed to hooks.
+type TargetResult struct {
+	Name  string `json:"name"`
+	Port  int    `json:"port,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// newPortChange describes the change from old to the ports of an update.
+func newPortChange(old []int, ports []int, source string, results []syncResult, now time.Time) PortChange {
+	change := PortChange{OldPorts: old, Ports: ports, Source: source, Time: now}
+	if change.OldPorts == nil {
+		change.OldPorts = []int{}
+	}
+	if len(old) > 0 {
+		change.OldPort = old[0]
+	}
+	if len(ports) > 0 {
+		change.NewPort = ports[0]
+	}
+	for _, r := range results {
+		t := TargetResult{Name: r.target}
+		if r.err != nil {
+			t.Error = r.err.Error()
+		} else {
+			t.Port = r.port
+		}
+		change.Targets = append(change.Targets, t)
+	}
+	return change
+}
+
+// env returns the change as GLUEBIT_* environment variables.
+func (c PortChange) env() []string {
+	var synced, failed []string
+	for _, t := range c.Targets {
+		if t.Error != "" {
+			failed = append(failed, t.Name)
+		} else {
+			synced = append(synced, t.Name)
+		}
+	}
+	return []string{
+		"GLUEBIT_OLD_PORT=" + strconv.Itoa(c.OldPort),
+		"GLUEBIT_NEW_PORT=" + strconv.Itoa(c.NewPort),
+		"GLUEBIT_PORTS=" + joinPorts(c.Ports),
+		"GLUEBIT_SOURCE=" + c.Source,
+		"GLUEBIT_SYNCED_TARGETS=" + strings.Join(synced, ","),
+		"GLUEBIT_FAILED_TARGETS=" + strings.Join(failed, ","),
+	}
+}
+
+// joinPorts joins ports with commas, for environment variables.
+func joinPorts(ports []int) string {
+	s := make([]string, len(ports))
+	for i, p := range ports {
+		s[i] = strconv.Itoa(p)
+	}
+	return strings.Join(s, ",")
+}
+
+// hookRunner runs the hooks of the config in the background,
+// at most --hookconcurrency at a time. The changes of a hook run one at a
+// time and in order, so that a slow hook never ends up on an older port.
+type hookRunner struct {
+	mu     sync.Mutex
+	sem    chan struct{}
+	queues map[string]*hookQueue // by hook, see run
+	wg     sync.WaitGroup
+}
+
+// hookQueue holds the change a hook runs with once its current run finished.
+type hookQueue struct {
+	next *hookRun
+}
+
+// hookRun is a run of a hook with a change.
+type hookRun struct {
+	config Config
+	hook   HookSpec
+	change PortChange
+}
+
+// run starts every hook with change.
+func (r *hookRunner) run(config Config, change PortChange) {
+	for i, hook := range config.hooks() {
+		r.enqueue(fmt.Sprintf("hooks[%d] %q", i, hook.Command), config, hook, change)
+	}
+}
+
+// enqueue runs hook with change once the runs of key before it finished.
+// A change that is still waiting is replaced by the newer one, keeping the old
+// ports it started from, as the hook only needs to end up on the newest ports.
+func (r *hookRunner) enqueue(key string, config Config, hook HookSpec, change PortChange) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.queues == nil {
+		r.queues = make(map[string]*hookQueue)
+	}
+	run := &hookRun{config: config, hook: hook, change: change}
+	if q, ok := r.queues[key]; ok {
+		if q.next != nil {
+			logger("hook").Debug("Skipping hook run replaced by a newer change", "hook", hook.name(), "ports", q.next.change.Ports)
+			run.change.OldPort, run.change.OldPorts = q.next.change.OldPort, q.next.change.OldPorts
+		}
+		q.next = run
+		return
+	}
+	r.queues[key] = &hookQueue{}
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		for run != nil {
+			sem := r.semaphore(run.config.HookConcurrency)
+			sem <- struct{}{}
+			logHook(run.hook, runHook(run.config, run.hook, run.change))
+			<-sem
+			run = r.dequeue(key)
+		}
+	}()
+}
+
+// dequeue returns the next run of key, or nil and removes the queue if there is none.
+func (r *hookRunner) dequeue(key string) *hookRun {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	q := r.queues[key]
+	run := q.next
+	q.next = nil
+	if run == nil {
+		delete(r.queues, key)
+	}
+	return run
+}
+
+// semaphore returns the semaphore that limits the hooks running at once,
+// replacing it if the limit was changed by a reload.
+func (r *hookRunner) semaphore(limit int) chan struct{} {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if limit < 1 {
+		limit = 1
+	}
+	if r.sem == nil || cap(r.sem) != limit {
+		r.sem = make(chan struct{}, limit)
+	}
+	return r.sem
+}
+
+// wait waits until every hook finished.
+func (r *hookRunner) wait() {
+	r.wg.Wait()
+}
+
+// hookResult is the outcome of running a hook.
+type hookResult struct {
+	output   []byte
+	duration time.Duration
+	err      error
+}
+
+// runHook runs hook with change in its environment and as JSON on stdin.
+// The hook is killed when it runs longer than its timeout.
+func runHook(config Config, hook HookSpec, change PortChange) hookResult {
+	ctx, cancel := context.WithTimeout(context.Background(), hook.timeout(config))
+	defer cancel()
+	input, err := json.Marshal(change)
+	if err != nil {
+		return hookResult{err: err}
+	}
+	cmd := exec.CommandContext(ctx, hook.Command[0], hook.Command[1:]...)
+	cmd.Env = append(os.Environ(), change.env()...)
+	extra := make([]string, 0, len(hook.Env))
+	for k, v := range hook.Env {
+		extra = append(extra, k+"="+v)
+	}
+	sort.Strings(extra)
+	cmd.Env = append(cmd.Env, extra...)
+	cmd.Stdin = bytes.NewReader(append(input, '\n'))
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	// do not wait forever for children of the hook that keep its output open
+	cmd.WaitDelay = time.Second
+	start := time.Now()
+	err = cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		err = fmt.Errorf("timed out after %s: %w", hook.timeout(config), err)
+	}
+	return hookResult{output: output.Bytes(), duration: time.Since(start), err: err}
+}
+
+// logHook logs the output and outcome of a hook, one line of output per entry.
+func logHook(hook HookSpec, result hookResult) {
+	output := result.output
+	if len(output) > maxHookOutput {
+		output = output[:maxHookOutput]
+		logger("hook").Warn("Hook output truncated", "hook", hook.name(), "limit", maxHookOutput)
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	scanner.Buffer(nil, maxHookOutput)
+	for scanner.Scan() {
+		logger("hook").Info("Hook output", "hook", hook.name(), "line", scanner.Text())
+	}
+	if result.err != nil {
+		logger("hook").Warn("Hook failed", "hook", hook.name(), "error", result.err, "duration", result.duration)
+		return
+	}
+	logger("hook").Info("Hook finished", "hook", hook.name(), "duration", result.duration)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunHook(t *testing.T) {
+	t.Parallel()
+
+	change := newPortChange([]int{51413}, []int{52000, 52001}, "gluetun-api", []syncResult{
+		{target: "qbittorrent", port: 52000},
+		{target: "seedbox", err: errors.New("connection refused")},
+	}, time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC))
+
+	hook := HookSpec{
+		Command: []string{"sh", "-c", `echo "$GLUEBIT_OLD_PORT $GLUEBIT_NEW_PORT $GLUEBIT_PORTS $GLUEBIT_SOURCE $GLUEBIT_SYNCED_TARGETS $GLUEBIT_FAILED_TARGETS $EXTRA"; cat`},
+		Env:     map[string]string{"EXTRA": "extra"},
+	}
+	result := runHook(Config{HookTimeout: 5}, hook, change)
+	if result.err != nil {
+		t.Fatal(result.err)
+	}
+	lines := strings.SplitN(string(result.output), "\n", 2)
+	if want := "51413 52000 52000,52001 gluetun-api qbittorrent seedbox extra"; lines[0] != want {
+		t.Errorf("Expected environment %q, got %q", want, lines[0])
+	}
+	for _, want := range []string{`"old_port":51413`, `"new_port":52000`, `"ports":[52000,52001]`, `{"name":"seedbox","error":"connection refused"}`} {
+		if !strings.Contains(lines[1], want) {
+			t.Errorf("Expected stdin to contain %s, got %s", want, lines[1])
+		}
+	}
+}
+
+func TestRunHookTimeout(t *testing.T) {
+	t.Parallel()
+
+	hook := HookSpec{Command: []string{"sleep", "5"}, Timeout: "100ms"}
+	start := time.Now()
+	result := runHook(Config{HookTimeout: 30}, hook, PortChange{})
+	if result.err == nil || !strings.Contains(result.err.Error(), "timed out after 100ms") {
+		t.Errorf("Expected a timeout, got %v", result.err)
+	}
+	if time.Since(start) > 3*time.Second {
+		t.Errorf("Expected the hook to be killed, it ran for %s", time.Since(start))
+	}
+}
+
+func TestEventTrackerHooks(t *testing.T) {
+	t.Parallel()
+
+	out := filepath.Join(t.TempDir(), "ports")
+	config := Config{
+		HookTimeout:     5,
+		HookConcurrency: 1,
+		Hooks:           []HookSpec{{Command: []string{"sh", "-c", `echo "$GLUEBIT_OLD_PORT $GLUEBIT_NEW_PORT" >> "$OUT"`}, Env: map[string]string{"OUT": out}}},
+	}
+	tracker := newEventTracker(State{Ports: []int{51413}})
+	updates := []struct {
+		ports   []int
+		results []syncResult
+	}{
+		// the same port runs no hook
+		{ports: []int{51413}, results: []syncResult{{target: "qbittorrent", port: 51413}}},
+		{ports: []int{52000}, results: []syncResult{{target: "qbittorrent", port: 52000}}},
+		// neither does a port that was not set in any target
+		{ports: []int{53000}, results: []syncResult{{target: "qbittorrent", err: errors.New("connection refused")}}},
+		{ports: []int{53000}, results: []syncResult{{target: "qbittorrent", port: 53000}}},
+	}
+	for _, u := range updates {
+		tracker.observe(config, u.results, u.ports, u.ports, "", time.Now())
+		tracker.wait()
+	}
+	b, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "51413 52000\n52000 53000\n"; string(b) != want {
+		t.Errorf("Expected hook runs %q, got %q", want, b)
+	}
+}
+
+func TestHookConcurrency(t *testing.T) {
+	t.Parallel()
+
+	out := filepath.Join(t.TempDir(), "runs")
+	hook := HookSpec{Command: []string{"sh", "-c", `echo start >> "$OUT"; sleep 0.1; echo end >> "$OUT"`}, Env: map[string]string{"OUT": out}}
+	config := Config{HookTimeout: 5, HookConcurrency: 1, Hooks: []HookSpec{hook, hook, hook}}
+	runner := &hookRunner{}
+	runner.run(config, PortChange{})
+	runner.wait()
+	b, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := strings.Repeat("start\nend\n", 3); string(b) != want {
+		t.Errorf("Expected the hooks to run one at a time, got %q", b)
+	}
+}
+
+func TestHookOrder(t *testing.T) {
+	t.Parallel()
+
+	out := filepath.Join(t.TempDir(), "runs")
+	// the first run is the slowest, so runs in parallel would finish out of order
+	hook := HookSpec{
+		Command: []string{"sh", "-c", `[ "$GLUEBIT_NEW_PORT" = 2 ] && sleep 0.3; echo "$GLUEBIT_OLD_PORT $GLUEBIT_NEW_PORT" >> "$OUT"`},
+		Env:     map[string]string{"OUT": out},
+	}
+	config := Config{HookTimeout: 5, HookConcurrency: 2, Hooks: []HookSpec{hook}}
+	runner := &hookRunner{}
+	for port := 2; port <= 5; port++ {
+		runner.run(config, newPortChange([]int{port - 1}, []int{port}, "", nil, time.Now()))
+	}
+	runner.wait()
+	b, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the runs for 3 and 4 were replaced while the first one ran
+	if want := "1 2\n2 5\n"; string(b) != want {
+		t.Errorf("Expected the runs of a hook in order, without the replaced ones, got %q", b)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"regexp"
+	"strings"
+)
+
+// redacted replaces credentials in logs.
+const redacted = "[REDACTED]"
+
+// minRedactLength is the shortest credential that is redacted wherever it
+// appears in logs. Shorter ones, such as a password "1", would also replace
+// parts of ports and hosts; they are only redacted by credentialKeys and
+// credentialPatterns.
+const minRedactLength = 6
+
+// logLevel is the level of the default logger, changed by reloads.
+var logLevel slog.LevelVar
+
+// credentialKeys are parts of log keys whose values are always redacted.
+var credentialKeys = []string{"password", "passwd", "token", "secret", "apikey", "api_key", "authorization", "cookie"}
+
+// credentialPatterns match credentials in log values that gluebit does not
+// know of, such as the password of a url or a token in its query.
+var credentialPatterns = []struct {
+	re   *regexp.Regexp
+	repl string
+}{
+	{re: regexp.MustCompile(`(://[^/\s:@]*:)[^/\s@]+@`), repl: "${1}" + redacted + "@"},
+	{re: regexp.MustCompile(`(?i)([?&](?:token|key|apikey|api_key|password|pass|secret|auth|sig)=)[^&\s"]+`), repl: "${1}" + redacted},
+	{re: regexp.MustCompile(`(?i)(bearer |basic )[^\s"]+`), repl: "${1}" + redacted},
+}
+
+// logger returns the default logger with the component attribute, e.g.
+// "sync" or "notify", so that logs can be filtered by what wrote them.
+func logger(component string) *slog.Logger {
+	return slog.Default().With("component", component)
+}
+
+// checkLogging reports problems with --log-level and --log-format.
+// Empty values mean info and text.
+func (c Config) checkLogging() error {
+	var errs []error
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.LogLevel)); c.LogLevel != "" && err != nil {
+		errs = append(errs, fmt.Errorf("--log-level %q must be debug, info, warn or error", c.LogLevel))
+	}
+	if c.LogFormat != "" && c.LogFormat != "text" && c.LogFormat != "json" {
+		errs = append(errs, fmt.Errorf("--log-format %q must be text or json", c.LogFormat))
+	}
+	return errors.Join(errs...)
+}
+
+// setupLogging makes the default logger write to w with the level and format
+// of the config, redacting its credentials. Invalid settings are left as they are.
+func setupLogging(config Config, w io.Writer) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(config.LogLevel)); err == nil || config.LogLevel == "" {
+		logLevel.Set(level)
+	}
+	slog.SetDefault(slog.New(newLogHandler(config, w, &logLevel)))
+}
+
+// newLogHandler returns a handler in the format of the config that
+// redacts its credentials.
+func newLogHandler(config Config, w io.Writer, level slog.Leveler) slog.Handler {
+	r := redactor{secrets: config.credentials()}
+	opts := &slog.HandlerOptions{Level: level, ReplaceAttr: r.replaceAttr}
+	if config.LogFormat == "json" {
+		return slog.NewJSONHandler(w, opts)
+	}
+	return slog.NewTextHandler(w, opts)
+}
+
+// credentials returns the credentials of the config, which are redacted
+// wherever they appear in logs.
+func (c Config) credentials() []string {
+	var s []string
+	for _, t := range c.targets() {
+		s = append(s, t.Password)
+	}
+	s = append(s, c.PiaToken)
+	for _, n := range c.notifiers() {
+		s = append(s, n.Token)
+		for _, v := range n.Headers {
+			s = append(s, v)
+		}
+		if n.Type == "discord" || n.Type == "slack" {
+			// the url of their webhooks is the credential
+			s = append(s, n.URL)
+		}
+	}
+	// the extra environment of commands often holds API keys
+	for _, v := range c.ExecEnv {
+		s = append(s, v)
+	}
+	for _, h := range c.hooks() {
+		for _, v := range h.Env {
+			s = append(s, v)
+		}
+	}
+	for _, t := range c.Templates {
+		for _, v := range t.Env {
+			s = append(s, v)
+		}
+	}
+	return s
+}
+
+// redactor removes credentials from log attributes.
+type redactor struct {
+	secrets []string
+}
+
+// replaceAttr redacts the values of credential keys, and credentials in
+// strings and errors.
+func (r redactor) replaceAttr(_ []string, a slog.Attr) slog.Attr {
+	key := strings.ToLower(a.Key)
+	for _, k := range credentialKeys {
+		if strings.Contains(key, k) {
+			return slog.String(a.Key, redacted)
+		}
+	}
+	if k := a.Value.Kind(); k != slog.KindString && k != slog.KindAny {
+		return a
+	}
+	switch v := a.Value.Any().(type) {
+	case string:
+		return slog.String(a.Key, r.redact(v))
+	case error:
+		return slog.String(a.Key, r.redact(v.Error()))
+	case fmt.Stringer:
+		return slog.String(a.Key, r.redact(v.String()))
+	}
+	return a
+}
+
+// redact replaces the known secrets and anything that looks like a
+// credential in s.
+func (r redactor) redact(s string) string {
+	for _, secret := range r.secrets {
+		if len(secret) >= minRedactLength {
+			s = strings.ReplaceAll(s, secret, redacted)
+		}
+	}
+	for _, p := range credentialPatterns {
+		s = p.re.ReplaceAllString(s, p.repl)
+	}
+	return s
+}
@@ -3,9 +3,9 @@ package main
 import (
 	"context"
 	"errors"
-	"log"
-	"log/slog"
+	"fmt"
 	"net/http"
+	"os"
 	"time"
 )
 
@@ -29,70 +29,302 @@ type GlueGetter interface {
 	GetGlueTunPort(Config, HttpDoer) (int, error)
 }
 
+// PortsGetter is implemented by GlueGetters that can return every forwarded port,
+// for targets that use another port than the first.
+type PortsGetter interface {
+	GetGlueTunPorts(Config, HttpDoer) ([]int, error)
+}
+
 // setPort is the main function of the program.
-// It gets the port from gluetun and sets it in qbittorrent.
-func setPort(config Config, client Preferencer, glue GlueGetter) error {
-	port, err := glue.GetGlueTunPort(config, client)
+// It gets the port of the target from gluetun and sets it in qbittorrent.
+// It returns the port that is set, and whether it was changed or qbittorrent
+// was already listening on it. With --dry-run, qbittorrent is not changed and
+// an error wrapping ErrDryRun describes the change instead.
+func setPort(config Config, target Target, client Preferencer, glue GlueGetter) (int, bool, error) {
+	log := logger("sync").With("target", target.Name)
+	forwarded, err := targetPort(config, target, client, glue)
 	if err != nil {
-		return err
+		return 0, false, err
+	}
+	if err := checkForwardedPorts([]int{forwarded}); err != nil {
+		return 0, false, err
+	}
+	log.Debug("Got forwarded port", "port", forwarded)
+	port, err := target.Translate.apply(forwarded)
+	if err != nil {
+		return 0, false, err
+	}
+	if port != forwarded {
+		log.Debug("Translated port", "forwarded", forwarded, "port", port, "rule", target.Translate)
+	}
+	if err := config.allowedPorts().check(port); err != nil {
+		if port != forwarded {
+			return 0, false, fmt.Errorf("forwarded port %d translated by %s: %w", forwarded, target.Translate, err)
+		}
+		return 0, false, err
 	}
-	slog.Debug("Got port from gluetun", "port", port)
 	pref, err := client.GetPreferences()
 	if err != nil {
-		return err
+		return 0, false, err
 	}
 	if pref.ListenPort == port {
-		slog.Info("Port already set")
-		return nil
+		log.Info("Port already set", "port", port)
+		return port, false, nil
+	}
+	previous := pref.ListenPort
+	if config.DryRun {
+		log.Info("Dry run, not setting port", "port", port, "previous", previous)
+		return port, false, fmt.Errorf("%w: would change port from %d to %d", ErrDryRun, previous, port)
 	}
 	pref.ListenPort = port
 	pref.RandomPort = false
 	err = client.SetPreferences(pref)
 	if err != nil {
-		return err
+		return 0, false, err
+	}
+	log.Info("Set port", "port", port, "previous", previous)
+	return port, true, nil
+}
+
+// targetPort returns the forwarded port at the port index of the target.
+func targetPort(config Config, target Target, client HttpDoer, glue GlueGetter) (int, error) {
+	if target.PortIndex == 0 {
+		return glue.GetGlueTunPort(config, client)
+	}
+	getter, ok := glue.(PortsGetter)
+	if !ok {
+		return 0, fmt.Errorf("port index %d needs a source that forwards several ports", target.PortIndex)
+	}
+	ports, err := getter.GetGlueTunPorts(config, client)
+	if err != nil {
+		return 0, err
+	}
+	if target.PortIndex >= len(ports) {
+		return 0, fmt.Errorf("port index %d needs %d forwarded ports, but only %d are forwarded", target.PortIndex, target.PortIndex+1, len(ports))
 	}
-	slog.Info("Set port to ", "port", port)
-	return nil
+	return ports[target.PortIndex], nil
+}
+
+// getPorts returns every forwarded port, or only the first one if glue
+// cannot return more.
+func getPorts(glue GlueGetter, config Config, client HttpDoer) ([]int, error) {
+	if getter, ok := glue.(PortsGetter); ok {
+		return getter.GetGlueTunPorts(config, client)
+	}
+	port, err := glue.GetGlueTunPort(config, client)
+	if err != nil {
+		return nil, err
+	}
+	return []int{port}, nil
+}
+
+// cycleGetter reads the ports once per update, so that every target
+// gets the same ports and the sources are not asked once per target.
+type cycleGetter struct {
+	glue  GlueGetter
+	done  bool
+	ports []int
+	err   error
+}
+
+func (c *cycleGetter) GetGlueTunPort(config Config, client HttpDoer) (int, error) {
+	return firstPort(c.GetGlueTunPorts(config, client))
+}
+
+func (c *cycleGetter) GetGlueTunPorts(config Config, client HttpDoer) ([]int, error) {
+	if !c.done {
+		c.ports, c.err = getPorts(c.glue, config, client)
+		c.done = true
+	}
+	return c.ports, c.err
+}
+
+// sourcer is implemented by GlueGetters that know the source of the last port.
+type sourcer interface {
+	Source() string
 }
 
 // run runs the program in a loop.
-func run(ctx context.Context, config Config, glue GlueGetter) error {
+// A new config received on reloads replaces the current one; only the
+// clients of targets whose settings changed are rebuilt.
+// The result of every update is recorded in state and saved if --statedir is set,
+// and changes are sent to the notifiers.
+func run(ctx context.Context, config Config, glue GlueGetter, state *State, reloads <-chan Config) error {
+	clients := newQbitClients()
+	events := newEventTracker(*state)
+	defer events.wait()
 	for {
-		client := getQbitClient(config)
-		err := setPort(config, client, glue)
-		if err != nil {
-			slog.Warn("Failed to set port: ", err)
+		var errs []error
+		for _, err := range update(config, clients, glue, state, events) {
+			if !errors.Is(err, ErrNoPort) && !errors.Is(err, ErrDryRun) {
+				errs = append(errs, err)
+			}
 		}
+		err := errors.Join(errs...)
 		if config.UpdateInterval == 0 {
 			return err
 		}
 		select {
 		case <-ctx.Done():
 			return nil
+		case newConfig := <-reloads:
+			clients.reload(changedTargets(config, newConfig))
+			config = newConfig
 		case <-time.After(time.Duration(config.UpdateInterval) * time.Second):
 		}
 	}
 }
 
-// getQbitClient returns a qbittorrent client.
-func getQbitClient(config Config) *Client {
-	tries := loginAttempts
-	for {
-		client, err := NewClient(config.qbitUrl(), config.QbitUsername, config.QbitPassword)
+// update sets the port of every target once, creating missing clients,
+// records the results in state and passes them to events. It returns the
+// error of every target that was not synced, wrapping ErrNoPort if no port is
+// forwarded yet or ErrDryRun if the port would have been changed.
+// Dry runs are not saved.
+func update(config Config, clients *qbitClients, glue GlueGetter, state *State, events *eventTracker) []error {
+	var errs []error
+	var results []syncResult
+	synced := false
+	cycle := &cycleGetter{glue: glue}
+	for _, target := range config.targets() {
+		var port int
+		var changed bool
+		var err error
+		// a target that cannot be reached or logged in to fails on its own
+		client, err := clients.get(config, target)
 		if err == nil {
-			return client
+			port, changed, err = setPort(config, target, client, cycle)
+		}
+		state.record(target.Name, port, err, time.Now())
+		results = append(results, syncResult{target: target.Name, port: port, changed: changed, err: err})
+		switch {
+		case err == nil:
+			synced = true
+		case errors.Is(err, ErrNoPort):
+			logger("sync").Info("No port forwarded yet, keeping the current port", "target", target.Name, "reason", err)
+		case errors.Is(err, ErrDryRun):
+		case errors.Is(err, ErrInvalidPort):
+			logger("sync").Warn("Ignoring invalid port, keeping the current port", "target", target.Name, "error", err)
+		default:
+			logger("sync").Warn("Failed to set port", "target", target.Name, "error", err)
+			// log in again on the next run
+			clients.logout(target.Name)
 		}
-		if errors.Is(err, ErrLoginfailed) || config.UpdateInterval == 0 || tries == 1 {
-			log.Fatalf("Cannot connect to qbittorrent: %s. Exiting...", err)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", target.Name, err))
+		}
+	}
+	source := ""
+	if s, ok := glue.(sourcer); ok {
+		source = s.Source()
+	}
+	if f, ok := glue.(flapCounter); ok {
+		state.SuppressedFlaps = f.Suppressed()
+	}
+	if !config.DryRun {
+		saveState(config, state, cycle.ports, source, synced, time.Now())
+	}
+	observed := cycle.ports
+	if o, ok := glue.(portObserver); ok {
+		observed = o.Observed()
+	}
+	events.observe(config, results, cycle.ports, observed, source, time.Now())
+	return errs
+}
+
+// newQbitClient returns a client for the qbittorrent target that is logged in.
+func newQbitClient(target Target) (*Client, error) {
+	httpClient, err := newHttpClient(target.TLS)
+	if err != nil {
+		return nil, fmt.Errorf("invalid TLS settings: %w", err)
+	}
+	return NewHttpClient(httpClient, target.url(), target.Username, target.Password)
+}
+
+// qbitClients holds the logged in client of every target, by target name.
+type qbitClients struct {
+	clients map[string]*Client
+	// failed holds the errors of targets that are not logged in to again
+	// until the next reload: qbittorrent bans the IP of a client after
+	// repeated failed logins, so a wrong password is only tried once.
+	failed map[string]error
+	// connected holds the targets that were logged in to since they were
+	// last changed. Connecting to any other target is retried, as
+	// qbittorrent may still be starting.
+	connected map[string]bool
+	delay     time.Duration
+}
+
+func newQbitClients() *qbitClients {
+	return &qbitClients{
+		clients:   make(map[string]*Client),
+		failed:    make(map[string]error),
+		connected: make(map[string]bool),
+		delay:     loginDelay,
+	}
+}
+
+// get returns the client of the target, logging in if needed.
+// The first connection to a target is tried up to loginAttempts times while
+// running as a daemon; later connection errors fail the update of the
+// target and are tried again on the next update.
+func (c *qbitClients) get(config Config, target Target) (*Client, error) {
+	if client, ok := c.clients[target.Name]; ok {
+		return client, nil
+	}
+	if err, ok := c.failed[target.Name]; ok {
+		return nil, err
+	}
+	httpClient, err := newHttpClient(target.TLS)
+	if err != nil {
+		err = fmt.Errorf("invalid TLS settings: %w", err)
+		c.failed[target.Name] = err
+		return nil, err
+	}
+	tries := 1
+	if config.UpdateInterval != 0 && !c.connected[target.Name] {
+		tries = loginAttempts
+	}
+	for {
+		client, err := NewHttpClient(httpClient, target.url(), target.Username, target.Password)
+		switch {
+		case err == nil:
+			c.clients[target.Name] = client
+			c.connected[target.Name] = true
+			return client, nil
+		case errors.Is(err, ErrLoginfailed):
+			err = fmt.Errorf("%w, not logging in again until the config is reloaded", err)
+			c.failed[target.Name] = err
+			return nil, err
 		}
 		tries--
-		slog.Info("Cannot connect to qbittorrent", "error", err, "retrying in", loginDelay/time.Second, "remaining attempts", tries)
-		time.Sleep(loginDelay)
+		if tries == 0 {
+			return nil, err
+		}
+		logger("sync").Info("Cannot connect to qbittorrent", "target", target.Name, "error", err, "retry_in", c.delay, "remaining_attempts", tries)
+		time.Sleep(c.delay)
+	}
+}
+
+// logout drops the client of a target, so that it logs in again on the
+// next update.
+func (c *qbitClients) logout(name string) {
+	delete(c.clients, name)
+}
+
+// reload drops the clients of the changed targets and forgets every failed
+// login, so that the targets log in again with the new config.
+func (c *qbitClients) reload(changed []string) {
+	for _, name := range changed {
+		delete(c.clients, name)
+		delete(c.connected, name)
 	}
+	c.failed = make(map[string]error)
 }
 
 func main() {
-	config := loadConfig()
-	// client := getQbitClient(config)
-	run(context.Background(), config, glueGetter{})
+	config, problems := loadConfig()
+	if code, ok := runCommand(os.Stdout, config, problems); ok {
+		os.Exit(code)
+	}
+	daemon(config)
 }
@@ -3,6 +3,9 @@ package main
 import (
 	"errors"
 	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -43,12 +46,13 @@ func TestSetPort(t *testing.T) {
 	t.Parallel()
 
 	tests := []struct {
-		name       string
-		client     *mockClient
-		glue       *mockGlueGetter
-		wantErr    bool
-		wantPort   int
-		wantRandom bool
+		name        string
+		client      *mockClient
+		glue        *mockGlueGetter
+		wantErr     bool
+		wantPort    int
+		wantChanged bool
+		wantRandom  bool
 	}{
 		{
 			name: "port already set",
@@ -73,8 +77,9 @@ func TestSetPort(t *testing.T) {
 			glue: &mockGlueGetter{
 				port: 1234,
 			},
-			wantPort: 1234,
-			wantErr:  false,
+			wantPort:    1234,
+			wantChanged: true,
+			wantErr:     false,
 		},
 		{
 			name: "get gluetun port error",
@@ -114,10 +119,13 @@ func TestSetPort(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			err := setPort(Config{}, tt.client, tt.glue)
+			_, changed, err := setPort(Config{}, Target{}, tt.client, tt.glue)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("setPort() error = %v, wantErr %v", err, tt.wantErr)
 			}
+			if changed != tt.wantChanged {
+				t.Errorf("setPort() changed = %v, wantChanged %v", changed, tt.wantChanged)
+			}
 			if tt.wantPort != 0 && tt.client.pref.ListenPort != tt.wantPort {
 				t.Errorf("setPort() port = %v, wantPort %v", tt.client.pref.ListenPort, tt.wantPort)
 			}
@@ -125,6 +133,66 @@ func TestSetPort(t *testing.T) {
 	}
 }
 
+func TestTargetPort(t *testing.T) {
+	t.Parallel()
+
+	portFile := filepath.Join(t.TempDir(), "forwarded_port")
+	if err := os.WriteFile(portFile, []byte(`{"ports": [11111, 22222]}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	config := Config{GlueTunPortFile: portFile, Sources: "gluetun-file"}
+
+	tt := []struct {
+		name     string
+		target   Target
+		glue     GlueGetter
+		wantPort int
+		wantErr  string
+	}{
+		{name: "first port", target: Target{Name: "qbittorrent"}, glue: &sourceChain{}, wantPort: 11111},
+		{name: "second port", target: Target{Name: "slskd", PortIndex: 1}, glue: &sourceChain{}, wantPort: 22222},
+		{name: "too few ports", target: Target{Name: "other", PortIndex: 2}, glue: &sourceChain{}, wantErr: "only 2 are forwarded"},
+		{name: "single port getter", target: Target{Name: "slskd", PortIndex: 1}, glue: &mockGlueGetter{port: 1234}, wantErr: "several ports"},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			port, err := targetPort(config, tc.target, http.DefaultClient, tc.glue)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("Expected error containing %q, got %v", tc.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if port != tc.wantPort {
+				t.Errorf("Expected port %d, got %d", tc.wantPort, port)
+			}
+		})
+	}
+}
+
+func TestCycleGetter(t *testing.T) {
+	t.Parallel()
+
+	// the ports are read once per update, whatever the number of targets
+	glue := &mockGlueGetter{port: 1234}
+	cycle := &cycleGetter{glue: glue}
+	for _, target := range []Target{{Name: "a"}, {Name: "b"}} {
+		client := &mockClient{}
+		if _, _, err := setPort(Config{}, target, client, cycle); err != nil {
+			t.Fatal(err)
+		}
+		if client.pref.ListenPort != 1234 {
+			t.Errorf("Expected port %d, got %d", 1234, client.pref.ListenPort)
+		}
+	}
+	if glue.runs != 1 {
+		t.Errorf("Expected 1 read, got %d", glue.runs)
+	}
+}
+
 // func TestRun(t *testing.T) {
 // 	t.Parallel()
 
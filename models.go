@@ -1,8 +1,10 @@
 package main
 
 // port is a struct used to parse the forwarded port from gluetun.
+// Newer versions of gluetun can forward several ports and list them all in Ports.
 type port struct {
-	Port int `json:"port" omitempty:"true"`
+	Port  int   `json:"port" omitempty:"true"`
+	Ports []int `json:"ports" omitempty:"true"`
 }
 
 type proxyTyp int
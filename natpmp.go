@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// NAT-PMP (RFC 6886) is used by ProtonVPN and others to forward a port
+// over a plain WireGuard or OpenVPN tunnel, without gluetun.
+
+const natpmpPort = 5351
+
+const (
+	natpmpOpUDP byte = 1
+	natpmpOpTCP byte = 2
+)
+
+// natpmpInternalPort is the internal port requested from the gateway.
+// ProtonVPN ignores it and forwards the mapped port to the same port.
+const natpmpInternalPort = 1
+
+var (
+	// natpmpTimeout is the initial time to wait for a response; it doubles on every attempt.
+	natpmpTimeout  = 250 * time.Millisecond
+	natpmpAttempts = 4
+	// natpmpRetryDelay is the time to wait before renewing again after a failure.
+	natpmpRetryDelay = 5 * time.Second
+)
+
+var ErrNatPmpNoResponse = errors.New("no response from NAT-PMP gateway")
+
+// natpmpResults describes the result codes of a NAT-PMP response.
+var natpmpResults = map[uint16]string{
+	1: "unsupported version",
+	2: "not authorized or refused",
+	3: "network failure",
+	4: "out of resources",
+	5: "unsupported opcode",
+}
+
+// natpmpMapping is a port mapping granted by a NAT-PMP gateway.
+type natpmpMapping struct {
+	port     int
+	lifetime time.Duration
+}
+
+// requestMapping requests a port mapping for the protocol given by op from a NAT-PMP gateway.
+// Requests are retried with an increasing timeout, as UDP packets may be lost.
+func requestMapping(gateway string, op byte, internalPort int, externalPort int, lifetime time.Duration) (natpmpMapping, error) {
+	var mapping natpmpMapping
+	conn, err := net.Dial("udp", addressWithPort(gateway, natpmpPort))
+	if err != nil {
+		return mapping, err
+	}
+	defer conn.Close()
+
+	req := make([]byte, 12)
+	req[1] = op
+	binary.BigEndian.PutUint16(req[4:], uint16(internalPort))
+	binary.BigEndian.PutUint16(req[6:], uint16(externalPort))
+	binary.BigEndian.PutUint32(req[8:], uint32(lifetime/time.Second))
+
+	resp := make([]byte, 16)
+	timeout := natpmpTimeout
+	for attempt := 0; attempt < natpmpAttempts; attempt, timeout = attempt+1, timeout*2 {
+		if _, err := conn.Write(req); err != nil {
+			return mapping, err
+		}
+		if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+			return mapping, err
+		}
+		n, err := conn.Read(resp)
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			continue
+		}
+		if err != nil {
+			return mapping, err
+		}
+		if n < len(resp) || resp[1] != 128+op {
+			// not the response to our request, ask again
+			continue
+		}
+		if result := binary.BigEndian.Uint16(resp[2:]); result != 0 {
+			return mapping, fmt.Errorf("NAT-PMP gateway refused mapping: %s (%d)", natpmpResults[result], result)
+		}
+		mapping.port = int(binary.BigEndian.Uint16(resp[10:]))
+		mapping.lifetime = time.Duration(binary.BigEndian.Uint32(resp[12:])) * time.Second
+		return mapping, nil
+	}
+	return mapping, ErrNatPmpNoResponse
+}
+
+// natpmpSource gets the forwarded port by requesting UDP and TCP mappings
+// from a NAT-PMP gateway.
+type natpmpSource struct {
+	mu      sync.Mutex
+	config  Config
+	port    int
+	expires time.Time
+}
+
+// checkNatPmp reports problems with the NAT-PMP settings.
+func checkNatPmp(c Config) error {
+	var errs []error
+	if c.NatPmpGateway == "" {
+		errs = append(errs, errors.New("needs --natpmpgateway"))
+	}
+	if c.NatPmpLifetime <= 0 {
+		errs = append(errs, fmt.Errorf("--natpmplifetime %d must be positive", c.NatPmpLifetime))
+	}
+	return errors.Join(errs...)
+}
+
+// newNatPmpSource returns a natpmpSource for the gateway in config.
+func newNatPmpSource(config Config) PortSource {
+	return &natpmpSource{config: config}
+}
+
+// Port returns the mapped port, requesting new mappings
+// if there are none or they have expired.
+func (n *natpmpSource) Port(_ context.Context, config Config, _ HttpDoer) (int, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if config.NatPmpGateway != n.config.NatPmpGateway {
+		// the mapping was granted by the old gateway
+		n.port = 0
+		n.expires = time.Time{}
+	}
+	n.config = config
+	if n.port != 0 && time.Now().Before(n.expires) {
+		return n.port, nil
+	}
+	if _, err := n.mapPort(); err != nil {
+		return 0, err
+	}
+	return n.port, nil
+}
+
+// mapPort requests UDP and TCP mappings and records the mapped port.
+// It returns the lifetime of the mappings. n.mu must be held.
+func (n *natpmpSource) mapPort() (time.Duration, error) {
+	gateway := n.config.NatPmpGateway
+	lifetime := time.Duration(n.config.NatPmpLifetime) * time.Second
+	udp, err := requestMapping(gateway, natpmpOpUDP, natpmpInternalPort, n.port, lifetime)
+	if err != nil {
+		return 0, fmt.Errorf("UDP mapping: %w", err)
+	}
+	tcp, err := requestMapping(gateway, natpmpOpTCP, natpmpInternalPort, udp.port, lifetime)
+	if err != nil {
+		return 0, fmt.Errorf("TCP mapping: %w", err)
+	}
+	if tcp.port != udp.port {
+		return 0, fmt.Errorf("NAT-PMP gateway mapped different ports for UDP (%d) and TCP (%d)", udp.port, tcp.port)
+	}
+	granted := udp.lifetime
+	if tcp.lifetime < granted {
+		granted = tcp.lifetime
+	}
+	if n.port != udp.port {
+		logger("source").Info("Got port from NAT-PMP gateway", "gateway", gateway, "port", udp.port, "lifetime", granted)
+	}
+	n.port = udp.port
+	n.expires = time.Now().Add(granted)
+	return granted, nil
+}
+
+// keepAlive renews the mappings at half their lifetime until ctx is done,
+// so that the port stays forwarded between updates.
+func (n *natpmpSource) keepAlive(ctx context.Context) {
+	for {
+		n.mu.Lock()
+		lifetime, err := n.mapPort()
+		n.mu.Unlock()
+		next := lifetime / 2
+		if err == nil && next < time.Second {
+			err = fmt.Errorf("NAT-PMP gateway granted a lifetime of %s", lifetime)
+		}
+		if err != nil {
+			logger("source").Warn("Failed to renew NAT-PMP mapping", "error", err, "retry_in", natpmpRetryDelay)
+			next = natpmpRetryDelay
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(next):
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// natpmpServer is a local stand-in for a NAT-PMP gateway.
+type natpmpServer struct {
+	conn     net.PacketConn
+	port     uint16 // mapped port returned for every request
+	lifetime uint32 // lifetime granted, if zero the requested lifetime is granted
+	result   uint16 // result code returned
+	drop     int    // number of requests to ignore before answering
+
+	mu       sync.Mutex
+	requests []byte // opcodes of the answered requests
+}
+
+// startNatPmpServer starts serving s on a local UDP port.
+func startNatPmpServer(t *testing.T, s *natpmpServer) *natpmpServer {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.conn = conn
+	t.Cleanup(func() { conn.Close() })
+	go s.serve()
+	return s
+}
+
+func (s *natpmpServer) addr() string {
+	return s.conn.LocalAddr().String()
+}
+
+func (s *natpmpServer) ops() []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]byte(nil), s.requests...)
+}
+
+func (s *natpmpServer) serve() {
+	buf := make([]byte, 12)
+	for {
+		n, addr, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		if s.drop > 0 || n != 12 {
+			s.drop--
+			s.mu.Unlock()
+			continue
+		}
+		s.requests = append(s.requests, buf[1])
+		s.mu.Unlock()
+
+		lifetime := s.lifetime
+		if lifetime == 0 {
+			lifetime = binary.BigEndian.Uint32(buf[8:])
+		}
+		resp := make([]byte, 16)
+		resp[1] = 128 + buf[1]
+		binary.BigEndian.PutUint16(resp[2:], s.result)
+		binary.BigEndian.PutUint32(resp[4:], 1000)
+		copy(resp[8:10], buf[4:6])
+		binary.BigEndian.PutUint16(resp[10:], s.port)
+		binary.BigEndian.PutUint32(resp[12:], lifetime)
+		s.conn.WriteTo(resp, addr)
+	}
+}
+
+func TestRequestMapping(t *testing.T) {
+	natpmpTimeout = 20 * time.Millisecond
+
+	t.Run("valid", func(t *testing.T) {
+		s := startNatPmpServer(t, &natpmpServer{port: 45678})
+		mapping, err := requestMapping(s.addr(), natpmpOpTCP, 1, 0, 60*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mapping.port != 45678 || mapping.lifetime != 60*time.Second {
+			t.Errorf("unexpected mapping: %+v", mapping)
+		}
+	})
+	t.Run("lost request is retried", func(t *testing.T) {
+		s := startNatPmpServer(t, &natpmpServer{port: 45678, drop: 2})
+		mapping, err := requestMapping(s.addr(), natpmpOpUDP, 1, 0, 60*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mapping.port != 45678 {
+			t.Errorf("unexpected mapping: %+v", mapping)
+		}
+	})
+	t.Run("no response", func(t *testing.T) {
+		s := startNatPmpServer(t, &natpmpServer{port: 45678, drop: natpmpAttempts})
+		if _, err := requestMapping(s.addr(), natpmpOpUDP, 1, 0, 60*time.Second); err != ErrNatPmpNoResponse {
+			t.Errorf("Expected %v, got %v", ErrNatPmpNoResponse, err)
+		}
+	})
+	t.Run("refused", func(t *testing.T) {
+		s := startNatPmpServer(t, &natpmpServer{port: 45678, result: 2})
+		if _, err := requestMapping(s.addr(), natpmpOpUDP, 1, 0, 60*time.Second); err == nil {
+			t.Error("Expected error, got nil")
+		}
+	})
+}
+
+func TestNatPmpGetter(t *testing.T) {
+	natpmpTimeout = 20 * time.Millisecond
+	s := startNatPmpServer(t, &natpmpServer{port: 45678})
+	config := Config{NatPmpGateway: s.addr(), NatPmpLifetime: 60}
+	n := newNatPmpSource(config)
+
+	port, err := n.Port(context.Background(), config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if port != 45678 {
+		t.Errorf("Expected port %d, got %d", 45678, port)
+	}
+	// both protocols are mapped
+	if ops := s.ops(); len(ops) != 2 || ops[0] != natpmpOpUDP || ops[1] != natpmpOpTCP {
+		t.Errorf("Expected UDP and TCP requests, got %v", ops)
+	}
+
+	// the mapping is reused until it expires
+	if _, err := n.Port(context.Background(), config, nil); err != nil {
+		t.Fatal(err)
+	}
+	if ops := s.ops(); len(ops) != 2 {
+		t.Errorf("Expected the mapping to be reused, got requests %v", ops)
+	}
+
+	// a new gateway is asked for a new mapping
+	other := startNatPmpServer(t, &natpmpServer{port: 45679})
+	config.NatPmpGateway = other.addr()
+	port, err = n.Port(context.Background(), config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if port != 45679 {
+		t.Errorf("Expected port %d from the new gateway, got %d", 45679, port)
+	}
+}
+
+func TestNatPmpKeepAlive(t *testing.T) {
+	natpmpTimeout = 20 * time.Millisecond
+	// renewed every second
+	s := startNatPmpServer(t, &natpmpServer{port: 45678, lifetime: 2})
+	n := newNatPmpSource(Config{NatPmpGateway: s.addr(), NatPmpLifetime: 2}).(*natpmpSource)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1500*time.Millisecond)
+	defer cancel()
+	n.keepAlive(ctx)
+	if ops := s.ops(); len(ops) != 4 {
+		t.Errorf("Expected the mappings to be renewed once, got requests %v", ops)
+	}
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// notifyTimeout bounds sending an event to a notifier.
+var notifyTimeout = 10 * time.Second
+
+// Notifier sends events somewhere, e.g. to a chat.
+type Notifier interface {
+	Notify(ctx context.Context, event Event) error
+}
+
+// NotifierSpec configures a notifier in the config file.
+type NotifierSpec struct {
+	Type    string            `yaml:"type" toml:"type"`
+	URL     string            `yaml:"url" toml:"url"`
+	Headers map[string]string `yaml:"headers" toml:"headers"`
+	// Body is a text/template of the request body of webhooks, the Event as JSON by default.
+	Body string `yaml:"body" toml:"body"`
+	// Token authenticates to ntfy and gotify.
+	Token string `yaml:"token" toml:"token"`
+	// Events are the event types to send, all of them by default.
+	Events []string `yaml:"events" toml:"events"`
+	// Priorities replace the default priorities of event types, from 1 (min) to 5 (urgent).
+	Priorities map[string]int `yaml:"priorities" toml:"priorities"`
+}
+
+// priority returns the priority of events of type t, from 1 to 5.
+func (s NotifierSpec) priority(t EventType) int {
+	if p, ok := s.Priorities[string(t)]; ok {
+		return p
+	}
+	return eventStyles[t].priority
+}
+
+// eventStyle is how the built-in notifiers present events of a type.
+type eventStyle struct {
+	title    string
+	priority int    // from 1 (min) to 5 (urgent), as in ntfy
+	tag      string // ntfy tag, shown as an emoji
+	emoji    string // slack emoji
+	color    int    // discord embed color
+}
+
+// eventStyles holds the default presentation of every event type.
+var eventStyles = map[EventType]eventStyle{
+	EventPortChanged: {title: "Port changed", priority: 3, tag: "arrows_counterclockwise", emoji: ":arrows_counterclockwise:", color: 0x3498db},
+	EventSyncFailed:  {title: "Sync failed", priority: 4, tag: "warning", emoji: ":warning:", color: 0xe67e22},
+	EventForwardLost: {title: "Port forward lost", priority: 4, tag: "rotating_light", emoji: ":rotating_light:", color: 0xe74c3c},
+	EventRecovered:   {title: "Recovered", priority: 3, tag: "white_check_mark", emoji: ":white_check_mark:", color: 0x2ecc71},
+}
+
+// title returns the title of event for the built-in notifiers.
+func title(event Event) string {
+	return "gluebit: " + eventStyles[event.Type].title
+}
+
+// wants reports whether the notifier sends events of type t.
+func (s NotifierSpec) wants(t EventType) bool {
+	if len(s.Events) == 0 {
+		return true
+	}
+	for _, e := range s.Events {
+		if EventType(e) == t {
+			return true
+		}
+	}
+	return false
+}
+
+// notifierType describes a kind of notifier.
+type notifierType struct {
+	new   func(NotifierSpec) Notifier // creates the notifier
+	check func(NotifierSpec) error    // reports missing or invalid settings of the notifier
+}
+
+// notifierTypes maps the name of every kind of notifier to its type.
+// New notifiers only need to be added here.
+var notifierTypes = map[string]notifierType{
+	"webhook": {
+		new:   newWebhook,
+		check: checkWebhook,
+	},
+	"ntfy": {
+		new:   newNtfy,
+		check: checkNotifyUrl,
+	},
+	"gotify": {
+		new:   newGotify,
+		check: checkGotify,
+	},
+	"discord": {
+		new:   newDiscord,
+		check: checkNotifyUrl,
+	},
+	"slack": {
+		new:   newSlack,
+		check: checkNotifyUrl,
+	},
+}
+
+// notifierNames returns the names of all notifiers, for errors.
+func notifierNames() string {
+	names := make([]string, 0, len(notifierTypes))
+	for name := range notifierTypes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// checkNotifier reports problems with the settings of a notifier.
+func checkNotifier(spec NotifierSpec) error {
+	typ, ok := notifierTypes[spec.Type]
+	if !ok {
+		return fmt.Errorf("unknown type %q, must be one of %s", spec.Type, notifierNames())
+	}
+	var errs []error
+	for _, e := range spec.Events {
+		if !knownEvent(EventType(e)) {
+			errs = append(errs, fmt.Errorf("unknown event %q", e))
+		}
+	}
+	for e, p := range spec.Priorities {
+		if !knownEvent(EventType(e)) {
+			errs = append(errs, fmt.Errorf("priority of unknown event %q", e))
+		}
+		if p < 1 || p > 5 {
+			errs = append(errs, fmt.Errorf("priority %d of %s must be between 1 and 5", p, e))
+		}
+	}
+	return errors.Join(append(errs, typ.check(spec))...)
+}
+
+// checkNotifyUrl reports problems with the url of a notifier.
+func checkNotifyUrl(spec NotifierSpec) error {
+	if spec.URL == "" {
+		return errors.New("needs a url")
+	}
+	return checkUrl(spec.URL)
+}
+
+// newNotifyRequest returns a POST request of body to rawUrl with the headers of spec.
+func newNotifyRequest(ctx context.Context, spec NotifierSpec, rawUrl string, contentType string, body []byte) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, rawUrl, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	for name, value := range spec.Headers {
+		req.Header.Set(name, value)
+	}
+	return req, nil
+}
+
+// knownEvent reports whether t is one of eventTypes.
+func knownEvent(t EventType) bool {
+	for _, known := range eventTypes {
+		if t == known {
+			return true
+		}
+	}
+	return false
+}
+
+// dispatcher sends events to the notifiers of the config in the background.
+// port_changed, forward_lost and recovered describe a change of state that the
+// eventTracker emits once, so they are always sent. sync_failed is sent at most
+// once per --notifyinterval and target: a newer one is held and sent when the
+// interval ends, replacing the ones before it, unless the target recovers first.
+type dispatcher struct {
+	now func() time.Time // for tests, time.Now if nil
+
+	mu         sync.Mutex
+	sent       map[string]time.Time     // when an event was last sent, by type and target
+	suppressed map[string]int           // held events replaced by a newer one, by type and target
+	pending    map[string]*pendingEvent // the held event, by type and target
+	wg         sync.WaitGroup
+}
+
+// pendingEvent is an event held back by rate limiting.
+type pendingEvent struct {
+	config Config
+	event  Event
+	timer  *time.Timer
+}
+
+// rateLimited reports whether events of type t are rate limited.
+func rateLimited(t EventType) bool {
+	return t == EventSyncFailed
+}
+
+// dispatch sends event to every notifier that wants it, or holds it back if it
+// is rate limited.
+func (d *dispatcher) dispatch(config Config, event Event) {
+	if len(config.notifiers()) == 0 {
+		return
+	}
+	if !d.allow(config, &event) {
+		logger("notify").Debug("Holding rate limited notification", "event", event.Type, "target", event.Target)
+		return
+	}
+	d.send(config, event)
+}
+
+// send sends event to every notifier that wants it in the background.
+func (d *dispatcher) send(config Config, event Event) {
+	for _, spec := range config.notifiers() {
+		if !spec.wants(event.Type) {
+			continue
+		}
+		notifier := notifierTypes[spec.Type].new(spec)
+		d.wg.Add(1)
+		go func(spec NotifierSpec) {
+			defer d.wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+			defer cancel()
+			if err := notifier.Notify(ctx, event); err != nil {
+				logger("notify").Warn("Failed to send notification", "notifier", spec.Type, "event", event.Type, "error", err)
+				return
+			}
+			logger("notify").Debug("Sent notification", "notifier", spec.Type, "event", event.Type)
+		}(spec)
+	}
+}
+
+// allow reports whether event may be sent now, and if so records it and sets
+// the number of events that were replaced before it. Otherwise the event is
+// held until the interval ends. A recovered event drops the held sync_failed
+// of its target, which is no longer true.
+func (d *dispatcher) allow(config Config, event *Event) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.sent == nil {
+		d.sent = make(map[string]time.Time)
+		d.suppressed = make(map[string]int)
+		d.pending = make(map[string]*pendingEvent)
+	}
+	if event.Type == EventRecovered {
+		failed := string(EventSyncFailed) + "/" + event.Target
+		if p := d.pending[failed]; p != nil {
+			p.timer.Stop()
+			delete(d.pending, failed)
+			d.suppressed[failed]++
+		}
+	}
+	if !rateLimited(event.Type) {
+		return true
+	}
+	now := d.clock()
+	key := string(event.Type) + "/" + event.Target
+	interval := time.Duration(config.NotifyInterval) * time.Second
+	last, ok := d.sent[key]
+	if !ok || now.Sub(last) >= interval {
+		d.sent[key] = now
+		event.Suppressed = d.suppressed[key]
+		d.suppressed[key] = 0
+		return true
+	}
+	if p := d.pending[key]; p != nil {
+		p.config, p.event = config, *event
+		d.suppressed[key]++
+		return false
+	}
+	d.pending[key] = &pendingEvent{
+		config: config,
+		event:  *event,
+		timer:  time.AfterFunc(last.Add(interval).Sub(now), func() { d.flush(key) }),
+	}
+	return false
+}
+
+// flush sends the held event of key, if any.
+func (d *dispatcher) flush(key string) {
+	d.mu.Lock()
+	p := d.pending[key]
+	if p == nil {
+		d.mu.Unlock()
+		return
+	}
+	p.timer.Stop()
+	delete(d.pending, key)
+	d.sent[key] = d.clock()
+	p.event.Suppressed = d.suppressed[key]
+	d.suppressed[key] = 0
+	d.mu.Unlock()
+	d.send(p.config, p.event)
+}
+
+// clock returns the current time.
+func (d *dispatcher) clock() time.Time {
+	if d.now != nil {
+		return d.now()
+	}
+	return time.Now()
+}
+
+// wait sends the held events and waits until every event was sent,
+// before the program exits.
+func (d *dispatcher) wait() {
+	d.mu.Lock()
+	keys := make([]string, 0, len(d.pending))
+	for key := range d.pending {
+		keys = append(keys, key)
+	}
+	d.mu.Unlock()
+	sort.Strings(keys)
+	for _, key := range keys {
+		d.flush(key)
+	}
+	d.wg.Wait()
+}
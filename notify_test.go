@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// notifyServer is a stand-in for a notification service that keeps the requests it got.
+type notifyServer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	requests []*http.Request
+	bodies   []string
+}
+
+func startNotifyServer(t *testing.T, status int) *notifyServer {
+	s := &notifyServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		s.mu.Lock()
+		s.requests = append(s.requests, r)
+		s.bodies = append(s.bodies, string(b))
+		s.mu.Unlock()
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *notifyServer) received() ([]*http.Request, []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests, s.bodies
+}
+
+func TestWebhook(t *testing.T) {
+	t.Parallel()
+
+	event := Event{Type: EventPortChanged, Target: "qbittorrent", Port: 52000, PreviousPort: 51413, Message: `port "changed"`}
+	tt := []struct {
+		name string
+		spec NotifierSpec
+		want string
+	}{
+		{name: "event as JSON", want: `"previous_port":51413`},
+		{name: "template", spec: NotifierSpec{Body: `{"text": {{json .Message}}, "port": {{.Port}}}`}, want: `{"text": "port \"changed\"", "port": 52000}`},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			server := startNotifyServer(t, http.StatusNoContent)
+			spec := tc.spec
+			spec.Type = "webhook"
+			spec.URL = server.URL
+			spec.Headers = map[string]string{"Authorization": "Bearer token"}
+			if err := newWebhook(spec).Notify(context.Background(), event); err != nil {
+				t.Fatal(err)
+			}
+			requests, bodies := server.received()
+			if len(requests) != 1 {
+				t.Fatalf("Expected 1 request, got %d", len(requests))
+			}
+			if got := requests[0].Header.Get("Authorization"); got != "Bearer token" {
+				t.Errorf("Expected the Authorization header, got %q", got)
+			}
+			if !strings.Contains(bodies[0], tc.want) {
+				t.Errorf("Expected body to contain %q, got %s", tc.want, bodies[0])
+			}
+		})
+	}
+}
+
+func TestWebhookError(t *testing.T) {
+	t.Parallel()
+
+	server := startNotifyServer(t, http.StatusUnauthorized)
+	err := newWebhook(NotifierSpec{URL: server.URL + "/hooks/secret-token"}).Notify(context.Background(), Event{Type: EventRecovered})
+	if err == nil || !strings.Contains(err.Error(), "401") {
+		t.Fatalf("Expected a 401 error, got %v", err)
+	}
+	if strings.Contains(err.Error(), "secret-token") {
+		t.Errorf("Expected the url path to be left out of the error, got %v", err)
+	}
+}
+
+func TestCheckNotifier(t *testing.T) {
+	t.Parallel()
+
+	tt := []struct {
+		spec    NotifierSpec
+		wantErr string
+	}{
+		{spec: NotifierSpec{Type: "webhook", URL: "https://chat.lan/hook"}},
+		{spec: NotifierSpec{Type: "pager"}, wantErr: `unknown type "pager"`},
+		{spec: NotifierSpec{Type: "webhook"}, wantErr: "needs a url"},
+		{spec: NotifierSpec{Type: "webhook", URL: "https://chat.lan/hook", Body: "{{.Port"}, wantErr: "body:"},
+		{spec: NotifierSpec{Type: "webhook", URL: "https://chat.lan/hook", Events: []string{"port_change"}}, wantErr: `unknown event "port_change"`},
+		{spec: NotifierSpec{Type: "ntfy", URL: "https://ntfy.sh/gluebit", Priorities: map[string]int{"sync_failed": 5}}},
+		{spec: NotifierSpec{Type: "ntfy", URL: "https://ntfy.sh/gluebit", Priorities: map[string]int{"sync_failed": 9}}, wantErr: "priority 9 of sync_failed must be between 1 and 5"},
+		{spec: NotifierSpec{Type: "slack"}, wantErr: "needs a url"},
+	}
+	for _, tc := range tt {
+		err := checkNotifier(tc.spec)
+		if tc.wantErr == "" {
+			if err != nil {
+				t.Errorf("Unexpected error for %+v: %s", tc.spec, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+			t.Errorf("Expected error containing %q for %+v, got %v", tc.wantErr, tc.spec, err)
+		}
+	}
+}
+
+func TestDispatcher(t *testing.T) {
+	t.Parallel()
+
+	server := startNotifyServer(t, http.StatusOK)
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	d := &dispatcher{now: func() time.Time { return now }}
+	config := Config{
+		NotifyInterval: 300,
+		Notifiers: []NotifierSpec{
+			{Type: "webhook", URL: server.URL},
+			{Type: "webhook", URL: server.URL, Events: []string{string(EventRecovered)}},
+		},
+	}
+
+	send := func(e Event) {
+		d.dispatch(config, e)
+		d.wg.Wait()
+	}
+	// changes of state are never rate limited, so the newest port is sent
+	send(Event{Type: EventPortChanged, Target: "qbittorrent", Port: 1})
+	now = now.Add(time.Minute)
+	send(Event{Type: EventPortChanged, Target: "qbittorrent", Port: 2})
+	send(Event{Type: EventPortChanged, Target: "qbittorrent", Port: 3})
+	send(Event{Type: EventSyncFailed, Target: "qbittorrent", Error: "a"})
+	// held, and replaced by the newer failure
+	now = now.Add(time.Minute)
+	send(Event{Type: EventSyncFailed, Target: "qbittorrent", Error: "b"})
+	send(Event{Type: EventSyncFailed, Target: "qbittorrent", Error: "c"})
+	// other targets are limited separately
+	send(Event{Type: EventSyncFailed, Target: "seedbox", Error: "d"})
+	// held, then dropped as the target recovers
+	send(Event{Type: EventSyncFailed, Target: "seedbox", Error: "e"})
+	send(Event{Type: EventRecovered, Target: "seedbox", Port: 3})
+	// the held events are sent when the interval ends, or on exit
+	d.wait()
+
+	_, bodies := server.received()
+	var got []Event
+	for _, b := range bodies {
+		var e Event
+		if err := json.Unmarshal([]byte(b), &e); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, e)
+	}
+	// the recovered event goes to both webhooks
+	want := []struct {
+		typ        EventType
+		port       int
+		err        string
+		suppressed int
+	}{
+		{typ: EventPortChanged, port: 1},
+		{typ: EventPortChanged, port: 2},
+		{typ: EventPortChanged, port: 3},
+		{typ: EventSyncFailed, err: "a"},
+		{typ: EventSyncFailed, err: "d"},
+		{typ: EventRecovered, port: 3},
+		{typ: EventRecovered, port: 3},
+		{typ: EventSyncFailed, err: "c", suppressed: 1},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("Expected %d notifications, got %+v", len(want), got)
+	}
+	for i, w := range want {
+		if got[i].Type != w.typ || got[i].Port != w.port || got[i].Error != w.err || got[i].Suppressed != w.suppressed {
+			t.Errorf("Notification %d: expected %+v, got %+v", i, w, got[i])
+		}
+	}
+}
+
+func TestDispatcherFlush(t *testing.T) {
+	t.Parallel()
+
+	server := startNotifyServer(t, http.StatusOK)
+	d := &dispatcher{}
+	config := Config{NotifyInterval: 1, Notifiers: []NotifierSpec{{Type: "webhook", URL: server.URL}}}
+	d.dispatch(config, Event{Type: EventSyncFailed, Target: "qbittorrent", Error: "a"})
+	d.dispatch(config, Event{Type: EventSyncFailed, Target: "qbittorrent", Error: "b"})
+	// the held event is sent when the interval ends
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if requests, _ := server.received(); len(requests) == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the held event to be sent after the interval")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	d.wait()
+}
+
+func TestDispatcherDryRun(t *testing.T) {
+	t.Parallel()
+
+	server := startNotifyServer(t, http.StatusOK)
+	tracker := newEventTracker(State{Targets: map[string]TargetState{"qbittorrent": {Port: 51413}}})
+	config := Config{DryRun: true, NotifyFailures: 1, Notifiers: []NotifierSpec{{Type: "webhook", URL: server.URL}}}
+	tracker.observe(config, []syncResult{{target: "qbittorrent", port: 52000}}, []int{52000}, []int{52000}, "", time.Now())
+	tracker.wait()
+	if requests, _ := server.received(); len(requests) != 0 {
+		t.Errorf("Expected no notifications in a dry run, got %d", len(requests))
+	}
+}
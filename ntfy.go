@@ -0,0 +1,32 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+)
+
+// ntfy publishes events to a ntfy topic, e.g. https://ntfy.sh/mytopic.
+// The message is the body; title, priority and tags are sent as headers.
+type ntfy struct {
+	spec   NotifierSpec
+	client HttpDoer
+}
+
+func newNtfy(spec NotifierSpec) Notifier {
+	return ntfy{spec: spec, client: http.DefaultClient}
+}
+
+func (n ntfy) Notify(ctx context.Context, event Event) error {
+	req, err := newNotifyRequest(ctx, n.spec, n.spec.URL, "text/plain; charset=utf-8", []byte(event.Message))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Title", title(event))
+	req.Header.Set("Priority", strconv.Itoa(n.spec.priority(event.Type)))
+	req.Header.Set("Tags", eventStyles[event.Type].tag)
+	if n.spec.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+n.spec.Token)
+	}
+	return postNotification(n.client, req)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestNtfy(t *testing.T) {
+	t.Parallel()
+
+	tt := []struct {
+		name         string
+		spec         NotifierSpec
+		event        Event
+		wantPriority string
+		wantTags     string
+		wantAuth     string
+	}{
+		{
+			name:         "port changed",
+			event:        Event{Type: EventPortChanged, Message: "qbittorrent: port changed from 51413 to 52000"},
+			wantPriority: "3",
+			wantTags:     "arrows_counterclockwise",
+		},
+		{
+			name:         "forward lost with token and priority",
+			spec:         NotifierSpec{Token: "tk_secret", Priorities: map[string]int{"forward_lost": 5}},
+			event:        Event{Type: EventForwardLost, Message: "No port is forwarded anymore"},
+			wantPriority: "5",
+			wantTags:     "rotating_light",
+			wantAuth:     "Bearer tk_secret",
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			server := startNotifyServer(t, 200)
+			spec := tc.spec
+			spec.URL = server.URL + "/gluebit"
+			if err := newNtfy(spec).Notify(context.Background(), tc.event); err != nil {
+				t.Fatal(err)
+			}
+			requests, bodies := server.received()
+			if len(requests) != 1 {
+				t.Fatalf("Expected 1 request, got %d", len(requests))
+			}
+			req := requests[0]
+			if req.URL.Path != "/gluebit" {
+				t.Errorf("Expected topic /gluebit, got %s", req.URL.Path)
+			}
+			if bodies[0] != tc.event.Message {
+				t.Errorf("Expected message %q, got %q", tc.event.Message, bodies[0])
+			}
+			if got := req.Header.Get("Title"); got != title(tc.event) {
+				t.Errorf("Expected title %q, got %q", title(tc.event), got)
+			}
+			if got := req.Header.Get("Priority"); got != tc.wantPriority {
+				t.Errorf("Expected priority %s, got %s", tc.wantPriority, got)
+			}
+			if got := req.Header.Get("Tags"); got != tc.wantTags {
+				t.Errorf("Expected tags %s, got %s", tc.wantTags, got)
+			}
+			if got := req.Header.Get("Authorization"); got != tc.wantAuth {
+				t.Errorf("Expected authorization %q, got %q", tc.wantAuth, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Private Internet Access forwards a port through an API on the gateway of
+// the VPN server. A signature for a port is requested with an auth token and
+// the port must then be bound every 15 minutes to keep it forwarded.
+// See https://github.com/pia-foss/manual-connections
+
+const piaPort = 19999
+
+var (
+	// piaBindInterval is how often the port is bound again.
+	piaBindInterval = 15 * time.Minute
+	// piaRetryDelay is the time to wait before trying again after a failure.
+	piaRetryDelay = time.Minute
+	// piaTimeout is the timeout of requests to the PIA gateway.
+	piaTimeout = 5 * time.Second
+)
+
+// piaResponse is the response of the getSignature and bindPort endpoints.
+type piaResponse struct {
+	Status    string `json:"status"`
+	Message   string `json:"message"`
+	Payload   string `json:"payload"`
+	Signature string `json:"signature"`
+}
+
+// piaPayload is the base64 encoded JSON payload returned by getSignature.
+type piaPayload struct {
+	Port      int       `json:"port"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// piaSource gets the forwarded port from the PIA port forwarding API.
+type piaSource struct {
+	mu        sync.Mutex
+	config    Config
+	payload   string
+	signature string
+	port      int
+	expires   time.Time
+	bound     time.Time
+	client    *http.Client // created on first use, see httpClient
+	clientKey string       // the CA file and hostname client was created for
+}
+
+// checkPia reports problems with the PIA settings.
+func checkPia(c Config) error {
+	if c.PiaGateway == "" || c.PiaHostname == "" || c.PiaToken == "" || c.PiaCAFile == "" {
+		return errors.New("needs --piagateway, --piahostname, --piatoken and --piacafile")
+	}
+	return nil
+}
+
+// newPiaSource returns a piaSource for the gateway in config.
+func newPiaSource(config Config) PortSource {
+	return &piaSource{config: config}
+}
+
+// Port returns the forwarded port, requesting a new signature if
+// there is none or it has expired and binding the port if it is due.
+func (p *piaSource) Port(_ context.Context, config Config, _ HttpDoer) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if config.PiaGateway != p.config.PiaGateway {
+		// the port was forwarded by the old gateway
+		p.port = 0
+	}
+	p.config = config
+	if err := p.refresh(false); err != nil {
+		return 0, err
+	}
+	return p.port, nil
+}
+
+// refresh gets a new signature when needed and binds the port if it is due or force is set.
+// p.mu must be held.
+func (p *piaSource) refresh(force bool) error {
+	if p.port == 0 || !time.Now().Before(p.expires) {
+		if err := p.getSignature(); err != nil {
+			return fmt.Errorf("PIA getSignature: %w", err)
+		}
+		p.bound = time.Time{}
+	}
+	if !force && time.Since(p.bound) < piaBindInterval {
+		return nil
+	}
+	if _, err := p.request("bindPort", url.Values{"payload": {p.payload}, "signature": {p.signature}}); err != nil {
+		return fmt.Errorf("PIA bindPort: %w", err)
+	}
+	p.bound = time.Now()
+	logger("source").Debug("Bound port on PIA gateway", "port", p.port, "expires", p.expires)
+	return nil
+}
+
+// getSignature requests a signed payload for a port and records the port and its expiry.
+func (p *piaSource) getSignature() error {
+	resp, err := p.request("getSignature", url.Values{"token": {p.config.PiaToken}})
+	if err != nil {
+		return err
+	}
+	b, err := base64.StdEncoding.DecodeString(resp.Payload)
+	if err != nil {
+		return fmt.Errorf("cannot decode payload: %w", err)
+	}
+	var payload piaPayload
+	if err := json.Unmarshal(b, &payload); err != nil {
+		return fmt.Errorf("cannot decode payload: %w", err)
+	}
+	p.payload = resp.Payload
+	p.signature = resp.Signature
+	p.port = payload.Port
+	p.expires = payload.ExpiresAt
+	logger("source").Info("Got port from PIA gateway", "port", p.port, "expires", p.expires)
+	return nil
+}
+
+// request calls an endpoint of the PIA gateway and returns its response.
+// A response with a status other than OK is an error.
+func (p *piaSource) request(endpoint string, params url.Values) (piaResponse, error) {
+	var result piaResponse
+	client, err := p.httpClient()
+	if err != nil {
+		return result, err
+	}
+	u := url.URL{
+		Scheme:   "https",
+		Host:     addressWithPort(p.config.PiaGateway, piaPort),
+		Path:     "/" + endpoint,
+		RawQuery: params.Encode(),
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), piaTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return result, err
+	}
+	resp, err := client.Do(req)
+	err = RespOk(resp, err)
+	if err != nil {
+		return result, err
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return result, err
+	}
+	if result.Status != "OK" {
+		return result, fmt.Errorf("status %s: %s", result.Status, result.Message)
+	}
+	return result, nil
+}
+
+// httpClient returns a client that connects to the gateway address but
+// verifies the certificate of the PIA server's hostname against PIA's CA.
+// The client is kept, so that its connections are reused, until the CA file
+// or hostname change. p.mu must be held.
+func (p *piaSource) httpClient() (*http.Client, error) {
+	key := p.config.PiaCAFile + "\n" + p.config.PiaHostname
+	if p.client != nil && p.clientKey == key {
+		return p.client, nil
+	}
+	tlsConfig, err := TLSOptions{CAFiles: []string{p.config.PiaCAFile}}.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig.ServerName = p.config.PiaHostname
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	p.client = &http.Client{Transport: transport}
+	p.clientKey = key
+	return p.client, nil
+}
+
+// keepAlive binds the port every piaBindInterval until ctx is done,
+// requesting a new signature when the current one expires.
+func (p *piaSource) keepAlive(ctx context.Context) {
+	for {
+		p.mu.Lock()
+		err := p.refresh(true)
+		p.mu.Unlock()
+		next := piaBindInterval
+		if err != nil {
+			logger("source").Warn("Failed to keep PIA port forwarded", "error", err, "retry_in", piaRetryDelay)
+			next = piaRetryDelay
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(next):
+		}
+	}
+}
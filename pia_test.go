@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// piaServer is a local stand-in for the port forwarding API of a PIA gateway.
+type piaServer struct {
+	*httptest.Server
+	port    int
+	expires time.Time
+
+	mu    sync.Mutex
+	binds int
+}
+
+func startPiaServer(t *testing.T, s *piaServer) *piaServer {
+	t.Helper()
+	payload := base64.StdEncoding.EncodeToString([]byte(
+		fmt.Sprintf(`{"token":"abc","port":%d,"expires_at":"%s"}`, s.port, s.expires.Format(time.RFC3339Nano))))
+	s.Server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/getSignature":
+			if r.URL.Query().Get("token") != "token" {
+				w.Write([]byte(`{"status":"ERROR","message":"invalid token"}`))
+				return
+			}
+			fmt.Fprintf(w, `{"status":"OK","payload":"%s","signature":"sig"}`, payload)
+		case "/bindPort":
+			if r.URL.Query().Get("payload") != payload || r.URL.Query().Get("signature") != "sig" {
+				w.Write([]byte(`{"status":"ERROR","message":"invalid signature"}`))
+				return
+			}
+			s.mu.Lock()
+			s.binds++
+			s.mu.Unlock()
+			w.Write([]byte(`{"status":"OK","message":"port scheduled for add"}`))
+		default:
+			t.Errorf("unexpected request path: %s", r.URL.Path)
+		}
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *piaServer) bindCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.binds
+}
+
+// piaConfig returns a config to reach s, trusting its certificate.
+func (s *piaServer) piaConfig(t *testing.T) Config {
+	return Config{
+		PiaGateway:  s.Listener.Addr().String(),
+		PiaHostname: "example.com", // the httptest certificate is valid for example.com
+		PiaToken:    "token",
+		PiaCAFile:   writePEM(t, t.TempDir(), "ca.crt", "CERTIFICATE", s.Certificate().Raw),
+	}
+}
+
+func TestPiaGetter(t *testing.T) {
+	t.Parallel()
+
+	s := startPiaServer(t, &piaServer{port: 47047, expires: time.Now().Add(24 * time.Hour)})
+	config := s.piaConfig(t)
+	p := newPiaSource(config).(*piaSource)
+
+	port, err := p.Port(context.Background(), config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if port != 47047 {
+		t.Errorf("Expected port %d, got %d", 47047, port)
+	}
+	if !p.expires.Equal(s.expires) {
+		t.Errorf("Expected expiry %s, got %s", s.expires, p.expires)
+	}
+	// the port is only bound again when due
+	if _, err := p.Port(context.Background(), config, nil); err != nil {
+		t.Fatal(err)
+	}
+	if binds := s.bindCount(); binds != 1 {
+		t.Errorf("Expected 1 bind, got %d", binds)
+	}
+
+	// a wrong token is reported
+	bad := config
+	bad.PiaToken = "wrong"
+	if _, err := newPiaSource(bad).Port(context.Background(), bad, nil); err == nil {
+		t.Error("Expected error, got nil")
+	}
+	// the certificate must match the hostname
+	bad = config
+	bad.PiaHostname = "other.example.org"
+	if _, err := newPiaSource(bad).Port(context.Background(), bad, nil); err == nil {
+		t.Error("Expected error, got nil")
+	}
+
+	// a reload that changes the hostname creates a new client
+	if _, err := p.Port(context.Background(), bad, nil); err != nil {
+		t.Fatal(err)
+	}
+	p.mu.Lock()
+	err = p.refresh(true)
+	p.mu.Unlock()
+	if err == nil {
+		t.Error("Expected error with the new hostname, got nil")
+	}
+}
+
+func TestPiaKeepAlive(t *testing.T) {
+	piaBindInterval = 50 * time.Millisecond
+	s := startPiaServer(t, &piaServer{port: 47047, expires: time.Now().Add(24 * time.Hour)})
+	p := newPiaSource(s.piaConfig(t)).(*piaSource)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	p.keepAlive(ctx)
+	if binds := s.bindCount(); binds < 3 {
+		t.Errorf("Expected the port to be bound repeatedly, got %d binds", binds)
+	}
+}
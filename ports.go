@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Ports outside of this range are not set in qbittorrent, unless the range is
+// changed with --minport and --maxport. Ports below 1024 need privileges.
+const (
+	defaultMinPort = 1024
+	defaultMaxPort = 65535
+)
+
+var (
+	// ErrNoPort means that no port is forwarded yet, e.g. gluetun reports port 0
+	// while the VPN connects. The port set in qbittorrent is kept.
+	ErrNoPort = errors.New("no port forwarded yet")
+	// ErrInvalidPort means that a port is not a valid port or not in the allowed range.
+	// The port set in qbittorrent is kept.
+	ErrInvalidPort = errors.New("invalid port")
+	// ErrDryRun means that the port would have been changed, but --dry-run is set.
+	ErrDryRun = errors.New("dry run")
+)
+
+// portRange is an inclusive range of ports.
+type portRange struct {
+	min, max int
+}
+
+// check returns an error wrapping ErrInvalidPort if port is not in the range.
+func (r portRange) check(port int) error {
+	if port < r.min || port > r.max {
+		return fmt.Errorf("%w %d: not between %d and %d", ErrInvalidPort, port, r.min, r.max)
+	}
+	return nil
+}
+
+// allowedPorts returns the range of ports that may be set in qbittorrent.
+func (c Config) allowedPorts() portRange {
+	r := portRange{min: defaultMinPort, max: defaultMaxPort}
+	if c.MinPort != 0 {
+		r.min = c.MinPort
+	}
+	if c.MaxPort != 0 {
+		r.max = c.MaxPort
+	}
+	return r
+}
+
+// checkForwardedPorts returns ErrNoPort if ports holds no port, and an error
+// wrapping ErrInvalidPort if one of them is not a valid port.
+// A missing port field in the response of gluetun decodes to port 0, so
+// port 0 means no port too.
+func checkForwardedPorts(ports []int) error {
+	if len(ports) == 0 || ports[0] == 0 {
+		return ErrNoPort
+	}
+	for _, port := range ports {
+		if port < 1 || port > 65535 {
+			return fmt.Errorf("%w %d forwarded", ErrInvalidPort, port)
+		}
+	}
+	return nil
+}
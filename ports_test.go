@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCheckForwardedPorts(t *testing.T) {
+	t.Parallel()
+
+	tt := []struct {
+		name    string
+		ports   []int
+		wantErr error
+	}{
+		{name: "valid", ports: []int{51413, 51414}},
+		{name: "no ports", wantErr: ErrNoPort},
+		{name: "port 0", ports: []int{0}, wantErr: ErrNoPort},
+		{name: "negative", ports: []int{-1}, wantErr: ErrInvalidPort},
+		{name: "too large", ports: []int{51413, 70000}, wantErr: ErrInvalidPort},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := checkForwardedPorts(tc.ports); !errors.Is(err, tc.wantErr) {
+				t.Errorf("Expected error %v, got %v", tc.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestAllowedPorts(t *testing.T) {
+	t.Parallel()
+
+	tt := []struct {
+		name    string
+		config  Config
+		port    int
+		wantErr bool
+	}{
+		{name: "default", port: 51413},
+		{name: "privileged", port: 80, wantErr: true},
+		{name: "lowest", port: 1024},
+		{name: "custom range", config: Config{MinPort: 50000, MaxPort: 51000}, port: 51413, wantErr: true},
+		{name: "privileged allowed", config: Config{MinPort: 1}, port: 80},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.config.allowedPorts().check(tc.port)
+			if tc.wantErr != errors.Is(err, ErrInvalidPort) {
+				t.Errorf("check(%d) error = %v, wantErr %v", tc.port, err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestSourceChainNoPort(t *testing.T) {
+	t.Parallel()
+
+	// gluetun reports port 0 until a port is forwarded
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"port": 0}`))
+	}))
+	defer server.Close()
+
+	chain := &sourceChain{}
+	if _, err := chain.GetGlueTunPort(Config{GlueTunUrl: server.URL}, http.DefaultClient); !errors.Is(err, ErrNoPort) {
+		t.Errorf("Expected error %v, got %v", ErrNoPort, err)
+	}
+}
+
+func TestSetPortKeepsPort(t *testing.T) {
+	t.Parallel()
+
+	tt := []struct {
+		name    string
+		config  Config
+		glue    GlueGetter
+		wantErr error
+	}{
+		{name: "port 0", glue: &mockGlueGetter{port: 0}, wantErr: ErrNoPort},
+		{name: "privileged port", glue: &mockGlueGetter{port: 443}, wantErr: ErrInvalidPort},
+		{name: "out of allowed range", config: Config{MaxPort: 50000}, glue: &mockGlueGetter{port: 51413}, wantErr: ErrInvalidPort},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			client := &mockClient{pref: Preferences{ListenPort: 6881}}
+			_, _, err := setPort(tc.config, Target{}, client, tc.glue)
+			if !errors.Is(err, tc.wantErr) {
+				t.Errorf("Expected error %v, got %v", tc.wantErr, err)
+			}
+			if client.pref.ListenPort != 6881 {
+				t.Errorf("Expected port %d to be kept, got %d", 6881, client.pref.ListenPort)
+			}
+		})
+	}
+}
@@ -50,23 +50,20 @@ type Client struct {
 }
 
 // NewClient creates a new Client for interacting with the qBittorrent API.
-func NewClient(url string, username string, password string) (*Client, error) {
-
-	// ensure url ends with "/"
-	if url[len(url)-1:] != "/" {
-		url += "/"
-	}
+// baseUrl may include a path, e.g. when qBittorrent is served behind a reverse proxy.
+func NewClient(baseUrl string, username string, password string) (*Client, error) {
+	return NewHttpClient(&http.Client{}, baseUrl, username, password)
+}
 
-	// create cookie jar
-	cliJar, _ := cookiejar.New(&cookiejar.Options{PublicSuffixList: publicsuffix.List})
-	client := &Client{
-		&http.Client{
-			Jar: cliJar,
-		},
-		url + "api/v2/",
+// NewHttpClient is like NewClient, but sends requests with httpClient,
+// e.g. to use custom TLS settings. A cookie jar is added to httpClient.
+func NewHttpClient(httpClient *http.Client, baseUrl string, username string, password string) (*Client, error) {
+	client, err := newLoggedOutClient(httpClient, baseUrl)
+	if err != nil {
+		return nil, err
 	}
 
-	err := client.Login(username, password)
+	err = client.Login(username, password)
 	if err != nil {
 		return nil, err
 	}
@@ -74,6 +71,22 @@ func NewClient(url string, username string, password string) (*Client, error) {
 	return client, nil
 }
 
+// newLoggedOutClient is like NewHttpClient, but does not log in.
+func newLoggedOutClient(httpClient *http.Client, baseUrl string) (*Client, error) {
+	apiUrl, err := url.JoinPath(baseUrl, "api/v2/")
+	if err != nil {
+		return nil, errwrp.Wrap(err, "invalid url")
+	}
+
+	// create cookie jar
+	cliJar, _ := cookiejar.New(&cookiejar.Options{PublicSuffixList: publicsuffix.List})
+	httpClient.Jar = cliJar
+	return &Client{
+		httpClient,
+		apiUrl,
+	}, nil
+}
+
 // postXwwwFormUrlencoded sends a POST request to the specified endpoint
 // with the given options encoded as x-www-form-urlencoded.
 // Returns the http.Response object and an error if any occurred.
@@ -145,6 +158,18 @@ func (c *Client) GetPreferences() (Preferences, error) {
 	return prefs, err
 }
 
+// Version returns the version of the qBittorrent app, e.g. v4.6.0.
+func (c *Client) Version() (string, error) {
+	resp, err := c.postXwwwFormUrlencoded("app/version", nil)
+	err = RespOk(resp, err)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	return string(b), err
+}
+
 // SetPreferences sets the preferences in the qBittorrent app.
 // It takes a Preferences struct as input and returns an error if any.
 func (c *Client) SetPreferences(pref Preferences) error {
@@ -164,14 +189,31 @@ func (c *Client) SetPreferences(pref Preferences) error {
 	return nil
 }
 
+// StatusError is returned by RespOk for responses other than 200 OK.
+// It matches ErrBadResponse with errors.Is.
+type StatusError struct {
+	StatusCode int
+	Status     string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%v: %s", ErrBadResponse, e.Status)
+}
+
+func (e *StatusError) Is(target error) bool {
+	return target == ErrBadResponse
+}
+
 // RespOk checks if the HTTP response is successful
 // (status code 200 OK) and returns an error if not.
 func RespOk(resp *http.Response, err error) error {
 	switch {
 	case err != nil:
 		return err
-	case resp.Status != "200 OK": // check for correct status code
-		return errwrp.Errorf("%v: %s", ErrBadResponse, resp.Status)
+	case resp.StatusCode != http.StatusOK: // check for correct status code
+		ignrBody(resp.Body)
+		resp.Body.Close()
+		return &StatusError{StatusCode: resp.StatusCode, Status: resp.Status}
 	default:
 		return nil
 	}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
 	"net/http/cookiejar"
 	"net/http/httptest"
@@ -135,6 +136,44 @@ func TestClient_GetPreferences(t *testing.T) {
 	}
 }
 
+func TestClient_Version(t *testing.T) {
+	t.Parallel()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v2/app/version" {
+			t.Fatalf("unexpected request path: %s", r.URL.Path)
+		}
+		if r.Header.Get("Cookie") == "" {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		w.Write([]byte("v4.6.0"))
+	}))
+	defer ts.Close()
+
+	client, err := newLoggedOutClient(&http.Client{}, ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// without a login cookie, the status code is returned
+	_, err = client.Version()
+	var status *StatusError
+	if !errors.As(err, &status) || status.StatusCode != http.StatusForbidden || !errors.Is(err, ErrBadResponse) {
+		t.Fatalf("expected a 403 status error, got %v", err)
+	}
+
+	u, _ := url.Parse(ts.URL)
+	client.Jar.SetCookies(u, []*http.Cookie{{Name: "SID", Value: "testvalue"}})
+	version, err := client.Version()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if version != "v4.6.0" {
+		t.Fatalf("unexpected version: %s", version)
+	}
+}
+
 func TestClient_SetPreferences(t *testing.T) {
 	t.Parallel()
 
@@ -178,3 +217,28 @@ func TestClient_SetPreferences(t *testing.T) {
 		t.Fatalf("unexpected error: %v", err)
 	}
 }
+
+func TestNewClient_BasePath(t *testing.T) {
+	t.Parallel()
+
+	// qBittorrent served on a sub-path behind a reverse proxy
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/qbittorrent/api/v2/auth/login" {
+			t.Errorf("unexpected request path: %s", r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(ResponseBodyOK))
+	}))
+	defer ts.Close()
+
+	for _, base := range []string{ts.URL + "/qbittorrent", ts.URL + "/qbittorrent/"} {
+		client, err := NewClient(base, "user", "pass")
+		if err != nil {
+			t.Fatalf("unexpected error for %s: %v", base, err)
+		}
+		if client.URL != ts.URL+"/qbittorrent/api/v2/" {
+			t.Errorf("unexpected api url: %s", client.URL)
+		}
+	}
+}
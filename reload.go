@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"reflect"
+	"sort"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// configPollInterval is how often the config file is checked for changes
+// when --watchconfig is set.
+var configPollInterval = 5 * time.Second
+
+// setting is a single config value, used to report what changed on reload.
+type setting struct {
+	value  string
+	secret bool
+}
+
+// settings returns the config as a flat map of named values.
+func (c Config) settings() map[string]setting {
+	s := map[string]setting{
+		"gluetun.url":        {value: c.GlueTunUrl},
+		"gluetun.host":       {value: c.GlueTunHost},
+		"gluetun.port":       {value: strconv.Itoa(c.GlueTunPort)},
+		"gluetun.portfile":   {value: c.GlueTunPortFile},
+		"gluetun.tls":        {value: fmt.Sprintf("%+v", c.gluetunTLS())},
+		"natpmp.gateway":     {value: c.NatPmpGateway},
+		"natpmp.lifetime":    {value: strconv.Itoa(c.NatPmpLifetime)},
+		"pia.gateway":        {value: c.PiaGateway},
+		"pia.hostname":       {value: c.PiaHostname},
+		"pia.token":          {value: c.PiaToken, secret: true},
+		"pia.cafile":         {value: c.PiaCAFile},
+		"exec.command":       {value: fmt.Sprintf("%q", c.execCommand())},
+		"exec.field":         {value: c.ExecField},
+		"exec.env":           {value: fmt.Sprintf("%v", c.execEnv()), secret: true},
+		"static.port":        {value: strconv.Itoa(c.StaticPort)},
+		"sources":            {value: fmt.Sprintf("%v", c.sources())},
+		"min_port":           {value: strconv.Itoa(c.MinPort)},
+		"max_port":           {value: strconv.Itoa(c.MaxPort)},
+		"stable_reads":       {value: strconv.Itoa(c.StableReads)},
+		"stable_time":        {value: strconv.Itoa(c.StableTime)},
+		"state_dir":          {value: c.StateDir},
+		"keep_last_port":     {value: strconv.FormatBool(c.KeepLastPort)},
+		"active_port.file":   {value: c.ActivePortFile},
+		"active_port.format": {value: c.ActivePortFormat},
+		"active_port.files":  {value: fmt.Sprintf("%+v", c.ActivePortFiles)},
+		"notify.failures":    {value: strconv.Itoa(c.NotifyFailures)},
+		"notify.interval":    {value: strconv.Itoa(c.NotifyInterval)},
+		"notifiers":          {value: fmt.Sprintf("%+v", c.notifiers()), secret: true},
+		"hooks":              {value: fmt.Sprintf("%+v", c.hooks()), secret: true},
+		"hook_timeout":       {value: strconv.Itoa(c.HookTimeout)},
+		"hook_concurrency":   {value: strconv.Itoa(c.HookConcurrency)},
+		"templates":          {value: fmt.Sprintf("%+v", c.Templates), secret: true},
+		"history.file":       {value: c.HistoryFile},
+		"history.max_size":   {value: strconv.Itoa(c.HistoryMaxSize)},
+		"history.keep":       {value: strconv.Itoa(c.HistoryKeep)},
+		"log.level":          {value: c.LogLevel},
+		"log.format":         {value: c.LogFormat},
+		"dry_run":            {value: strconv.FormatBool(c.DryRun)},
+		"interval":           {value: strconv.Itoa(c.UpdateInterval)},
+	}
+	for _, t := range c.targets() {
+		s[t.Name+".url"] = setting{value: t.URL}
+		s[t.Name+".host"] = setting{value: t.Host}
+		s[t.Name+".port"] = setting{value: strconv.Itoa(t.Port)}
+		s[t.Name+".username"] = setting{value: t.Username}
+		s[t.Name+".password"] = setting{value: t.Password, secret: true}
+		s[t.Name+".tls"] = setting{value: fmt.Sprintf("%+v", t.TLS)}
+		s[t.Name+".port_index"] = setting{value: strconv.Itoa(t.PortIndex)}
+		s[t.Name+".translate"] = setting{value: t.Translate.String()}
+	}
+	return s
+}
+
+// configDiff describes every setting that differs between two configs.
+// Values of secrets are never included.
+func configDiff(old, new Config) []string {
+	before, after := old.settings(), new.settings()
+	var changes []string
+	for name, b := range before {
+		a, ok := after[name]
+		switch {
+		case !ok:
+			changes = append(changes, fmt.Sprintf("%s removed", name))
+		case a.value == b.value:
+		case a.secret || b.secret:
+			changes = append(changes, fmt.Sprintf("%s changed", name))
+		default:
+			changes = append(changes, fmt.Sprintf("%s changed from %q to %q", name, b.value, a.value))
+		}
+	}
+	for name, a := range after {
+		if _, ok := before[name]; ok {
+			continue
+		}
+		if a.secret {
+			changes = append(changes, fmt.Sprintf("%s added", name))
+		} else {
+			changes = append(changes, fmt.Sprintf("%s added as %q", name, a.value))
+		}
+	}
+	sort.Strings(changes)
+	return changes
+}
+
+// changedTargets returns the names of the targets of old that were
+// changed or removed in new.
+func changedTargets(old, new Config) []string {
+	current := make(map[string]Target)
+	for _, t := range new.targets() {
+		current[t.Name] = t
+	}
+	var names []string
+	for _, t := range old.targets() {
+		if n, ok := current[t.Name]; !ok || !reflect.DeepEqual(n, t) {
+			names = append(names, t.Name)
+		}
+	}
+	return names
+}
+
+// modTime returns the modification time of a file, or the zero time if it cannot be read.
+func modTime(path string) time.Time {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+// watchConfig reloads the config on SIGHUP and, with --watchconfig, whenever
+// the config file changes. A new config is validated before it is sent on
+// reloads; invalid configs are logged and the current config is kept.
+func watchConfig(ctx context.Context, config Config, reloads chan<- Config) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	var poll <-chan time.Time
+	if config.WatchConfig && config.ConfigFile != "" {
+		ticker := time.NewTicker(configPollInterval)
+		defer ticker.Stop()
+		poll = ticker.C
+	}
+	lastMod := modTime(config.ConfigFile)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			logger("config").Info("Received SIGHUP, reloading config")
+		case <-poll:
+			mod := modTime(config.ConfigFile)
+			if mod.Equal(lastMod) {
+				continue
+			}
+			lastMod = mod
+			logger("config").Info("Config file changed, reloading config", "path", config.ConfigFile)
+		}
+
+		newConfig, _, err := parseConfig()
+		if err != nil {
+			logger("config").Warn("Invalid config, keeping the current one", "error", err)
+			continue
+		}
+		changes := configDiff(config, newConfig)
+		if len(changes) == 0 {
+			logger("config").Info("Config unchanged")
+			continue
+		}
+		for _, change := range changes {
+			logger("config").Info("Config reloaded", "change", change)
+		}
+		config = newConfig
+		setupLogging(config, os.Stderr)
+		select {
+		case <-ctx.Done():
+			return
+		case reloads <- newConfig:
+		}
+	}
+}
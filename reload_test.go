@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConfigDiff(t *testing.T) {
+	t.Parallel()
+
+	old := Config{
+		QbitHost:     "localhost",
+		QbitPort:     8080,
+		QbitPassword: "oldpass",
+		Targets:      []Target{{Name: "seedbox", Host: "seedbox.lan", Port: 8080}},
+	}
+	new := Config{
+		QbitHost:       "localhost",
+		QbitPort:       9090,
+		QbitPassword:   "newpass",
+		UpdateInterval: 30,
+		Targets:        []Target{{Name: "other", Host: "other.lan", Port: 8080, Password: "secret"}},
+	}
+	changes := configDiff(old, new)
+	want := []string{
+		`interval changed from "0" to "30"`,
+		`qbittorrent.port changed from "8080" to "9090"`,
+		`qbittorrent.password changed`,
+		`seedbox.host removed`,
+		`other.host added as "other.lan"`,
+		`other.password added`,
+	}
+	all := strings.Join(changes, "\n")
+	for _, w := range want {
+		if !strings.Contains(all, w) {
+			t.Errorf("Expected changes to contain %q, got %q", w, all)
+		}
+	}
+	for _, secret := range []string{"oldpass", "newpass", "secret"} {
+		if strings.Contains(all, secret) {
+			t.Errorf("Expected secret %q to be redacted, got %q", secret, all)
+		}
+	}
+	if changes := configDiff(old, old); len(changes) != 0 {
+		t.Errorf("Expected no changes, got %q", changes)
+	}
+}
+
+func TestChangedTargets(t *testing.T) {
+	t.Parallel()
+
+	old := Config{
+		QbitHost: "localhost",
+		QbitPort: 8080,
+		Targets: []Target{
+			{Name: "same", Host: "same.lan", Port: 8080},
+			{Name: "changed", Host: "changed.lan", Port: 8080},
+			{Name: "removed", Host: "removed.lan", Port: 8080},
+		},
+	}
+	new := Config{
+		QbitHost: "localhost",
+		QbitPort: 8080,
+		Targets: []Target{
+			{Name: "same", Host: "same.lan", Port: 8080},
+			{Name: "changed", Host: "changed.lan", Port: 8080, Password: "new"},
+			{Name: "added", Host: "added.lan", Port: 8080},
+		},
+	}
+	got := strings.Join(changedTargets(old, new), ",")
+	if got != "changed,removed" {
+		t.Errorf("Expected changed targets 'changed,removed', got '%s'", got)
+	}
+}
+
+func TestWatchConfig(t *testing.T) {
+	configPollInterval = 10 * time.Millisecond
+	path := filepath.Join(t.TempDir(), "gluebit.yaml")
+	if err := os.WriteFile(path, []byte("interval: 30\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	os.Args = []string{"cmd", "--config", path, "--watchconfig"}
+	config, _ := loadConfig()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	reloads := make(chan Config)
+	go watchConfig(ctx, config, reloads)
+
+	// an invalid config is not sent
+	mtime := time.Now().Add(time.Second)
+	if err := os.WriteFile(path, []byte("interval: -1\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(path, mtime, mtime)
+	select {
+	case c := <-reloads:
+		t.Fatalf("Expected invalid config to be ignored, got %+v", c)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	mtime = mtime.Add(time.Second)
+	if err := os.WriteFile(path, []byte("interval: 45\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(path, mtime, mtime)
+	select {
+	case c := <-reloads:
+		if c.UpdateInterval != 45 {
+			t.Errorf("Expected UpdateInterval to be 45, but got %d", c.UpdateInterval)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected config to be reloaded")
+	}
+}
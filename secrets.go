@@ -0,0 +1,57 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// secret is a config value that can also be read from a file,
+// such as a docker or compose secret mounted in /run/secrets.
+type secret struct {
+	name  string  // name of the setting, used in errors
+	value *string // the value set directly
+	file  string  // path to read the value from
+}
+
+// secrets returns the config values that can be read from files.
+// Future credentials should be added here to get the same behaviour.
+func (c *Config) secrets() []secret {
+	s := []secret{
+		{name: "qbittorrent username", value: &c.QbitUsername, file: c.QbitUserFile},
+		{name: "qbittorrent password", value: &c.QbitPassword, file: c.QbitPassFile},
+		{name: "PIA token", value: &c.PiaToken, file: c.PiaTokenFile},
+	}
+	for i := range c.Targets {
+		t := &c.Targets[i]
+		s = append(s,
+			secret{name: t.Name + " username", value: &t.Username, file: t.UsernameFile},
+			secret{name: t.Name + " password", value: &t.Password, file: t.PasswordFile},
+		)
+	}
+	return s
+}
+
+// readSecretFiles sets every secret that has a file to the trimmed contents of that file.
+// It is an error to set a secret both directly and from a file with different values.
+func (c *Config) readSecretFiles() error {
+	var errs []error
+	for _, s := range c.secrets() {
+		if s.file == "" {
+			continue
+		}
+		b, err := os.ReadFile(s.file)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("cannot read %s: %w", s.name, err))
+			continue
+		}
+		value := strings.TrimSpace(string(b))
+		if *s.value != "" && *s.value != value {
+			errs = append(errs, fmt.Errorf("%s is set both directly and in file %s with different values", s.name, s.file))
+			continue
+		}
+		*s.value = value
+	}
+	return errors.Join(errs...)
+}
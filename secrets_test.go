@@ -0,0 +1,73 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadSecretFiles(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	passFile := filepath.Join(dir, "qbitpass")
+	if err := os.WriteFile(passFile, []byte("  s3cret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tt := []struct {
+		name     string
+		config   Config
+		wantPass string
+		wantErr  bool
+	}{
+		{
+			name:     "file only",
+			config:   Config{QbitPassFile: passFile},
+			wantPass: "s3cret",
+		},
+		{
+			name:     "same value set directly",
+			config:   Config{QbitPassword: "s3cret", QbitPassFile: passFile},
+			wantPass: "s3cret",
+		},
+		{
+			name:    "different value set directly",
+			config:  Config{QbitPassword: "other", QbitPassFile: passFile},
+			wantErr: true,
+		},
+		{
+			name:    "missing file",
+			config:  Config{QbitPassFile: filepath.Join(dir, "DNE")},
+			wantErr: true,
+		},
+		{
+			name:     "no file",
+			config:   Config{QbitPassword: "plain"},
+			wantPass: "plain",
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.config.readSecretFiles()
+			if tc.wantErr && err == nil {
+				t.Fatal("Expected error, got nil")
+			}
+			if !tc.wantErr && err != nil {
+				t.Fatal(err)
+			}
+			if !tc.wantErr && tc.config.QbitPassword != tc.wantPass {
+				t.Errorf("Expected password '%s', got '%s'", tc.wantPass, tc.config.QbitPassword)
+			}
+		})
+	}
+
+	// secret files of targets from the config file are read too
+	config := Config{Targets: []Target{{Name: "seedbox", PasswordFile: passFile}}}
+	if err := config.readSecretFiles(); err != nil {
+		t.Fatal(err)
+	}
+	if config.Targets[0].Password != "s3cret" {
+		t.Errorf("Expected target password 's3cret', got '%s'", config.Targets[0].Password)
+	}
+}
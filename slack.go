@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// slackEscaper escapes the characters that Slack uses for markup.
+var slackEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+// slack posts events to a Slack incoming webhook.
+// Urgent events (priority 5) mention the channel.
+type slack struct {
+	spec   NotifierSpec
+	client HttpDoer
+}
+
+func newSlack(spec NotifierSpec) Notifier {
+	return slack{spec: spec, client: http.DefaultClient}
+}
+
+func (s slack) Notify(ctx context.Context, event Event) error {
+	text := fmt.Sprintf("%s *%s*\n%s", eventStyles[event.Type].emoji, title(event), slackEscaper.Replace(event.Message))
+	if s.spec.priority(event.Type) >= 5 {
+		text = "<!channel> " + text
+	}
+	body, err := json.Marshal(map[string]string{"text": text})
+	if err != nil {
+		return err
+	}
+	req, err := newNotifyRequest(ctx, s.spec, s.spec.URL, "application/json", body)
+	if err != nil {
+		return err
+	}
+	return postNotification(s.client, req)
+}
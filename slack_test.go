@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+)
+
+func TestSlack(t *testing.T) {
+	t.Parallel()
+
+	tt := []struct {
+		name  string
+		spec  NotifierSpec
+		event Event
+		want  string
+	}{
+		{
+			name:  "port changed",
+			event: Event{Type: EventPortChanged, Message: "qbittorrent: port changed from 51413 to 52000"},
+			want:  ":arrows_counterclockwise: *gluebit: Port changed*\nqbittorrent: port changed from 51413 to 52000",
+		},
+		{
+			name:  "escaped and urgent",
+			spec:  NotifierSpec{Priorities: map[string]int{"forward_lost": 5}},
+			event: Event{Type: EventForwardLost, Message: "No port is forwarded anymore: <nil> & more"},
+			want:  "<!channel> :rotating_light: *gluebit: Port forward lost*\nNo port is forwarded anymore: &lt;nil&gt; &amp; more",
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			server := startNotifyServer(t, 200)
+			spec := tc.spec
+			spec.URL = server.URL + "/services/T000/B000/XXXX"
+			if err := newSlack(spec).Notify(context.Background(), tc.event); err != nil {
+				t.Fatal(err)
+			}
+			_, bodies := server.received()
+			if len(bodies) != 1 {
+				t.Fatalf("Expected 1 request, got %d", len(bodies))
+			}
+			var msg struct {
+				Text string `json:"text"`
+			}
+			if err := json.Unmarshal([]byte(bodies[0]), &msg); err != nil {
+				t.Fatal(err)
+			}
+			if msg.Text != tc.want {
+				t.Errorf("Expected text %q, got %q", tc.want, msg.Text)
+			}
+		})
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PortSource finds out the forwarded port, e.g. from gluetun or a VPN gateway.
+// client is the qbittorrent client, which sources may use for http requests.
+type PortSource interface {
+	Port(ctx context.Context, config Config, client HttpDoer) (int, error)
+}
+
+// multiPortSource is implemented by port sources that can forward several ports.
+// The first port is the one returned by Port.
+type multiPortSource interface {
+	Ports(ctx context.Context, config Config, client HttpDoer) ([]int, error)
+}
+
+// keepAliver is implemented by port sources that must renew the forwarded
+// port in the background, between updates.
+type keepAliver interface {
+	keepAlive(ctx context.Context)
+}
+
+// sourceType describes a kind of port source.
+type sourceType struct {
+	timeout time.Duration           // default timeout of the source
+	new     func(Config) PortSource // creates the source
+	check   func(Config) error      // reports missing or invalid settings of the source
+}
+
+// portSources maps the name of every kind of port source to its type.
+// New sources only need to be added here.
+var portSources = map[string]sourceType{
+	"gluetun-api": {
+		timeout: time.Second,
+		new:     func(Config) PortSource { return &gluetunApiSource{} },
+		check:   checkGluetunApi,
+	},
+	"gluetun-file": {
+		timeout: time.Second,
+		new:     func(Config) PortSource { return gluetunFileSource{} },
+		check: func(c Config) error {
+			if c.GlueTunPortFile == "" {
+				return errors.New("needs --gluetunportfile")
+			}
+			return nil
+		},
+	},
+	"natpmp": {
+		timeout: 10 * time.Second,
+		new:     newNatPmpSource,
+		check:   checkNatPmp,
+	},
+	"pia": {
+		timeout: 15 * time.Second,
+		new:     newPiaSource,
+		check:   checkPia,
+	},
+	"static": {
+		timeout: time.Second,
+		new:     func(Config) PortSource { return staticSource{} },
+		check:   checkStatic,
+	},
+	"exec": {
+		timeout: 10 * time.Second,
+		new:     func(Config) PortSource { return execSource{} },
+		check:   checkExec,
+	},
+}
+
+// sourceNames returns the names of all port sources, for errors.
+func sourceNames() string {
+	names := make([]string, 0, len(portSources))
+	for name := range portSources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// SourceSpec configures one port source in the chain.
+type SourceSpec struct {
+	Type    string `yaml:"type" toml:"type"`
+	Timeout string `yaml:"timeout" toml:"timeout"`
+}
+
+// timeout returns the timeout of the source, or its default if not set.
+func (s SourceSpec) timeout() time.Duration {
+	if d, err := time.ParseDuration(s.Timeout); err == nil {
+		return d
+	}
+	return portSources[s.Type].timeout
+}
+
+// check reports problems with the spec and the settings of its source.
+func (s SourceSpec) check(c Config) error {
+	t, ok := portSources[s.Type]
+	if !ok {
+		return fmt.Errorf("unknown port source %q, use one of %s", s.Type, sourceNames())
+	}
+	var errs []error
+	if s.Timeout != "" {
+		if d, err := time.ParseDuration(s.Timeout); err != nil || d <= 0 {
+			errs = append(errs, fmt.Errorf("source %s: invalid timeout %q", s.Type, s.Timeout))
+		}
+	}
+	if err := t.check(c); err != nil {
+		errs = append(errs, fmt.Errorf("source %s: %w", s.Type, err))
+	}
+	return errors.Join(errs...)
+}
+
+// parseSources parses a comma separated list of sources,
+// each optionally followed by a colon and a timeout, e.g. "gluetun-api:2s,gluetun-file".
+func parseSources(list string) []SourceSpec {
+	var specs []SourceSpec
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		typ, timeout, _ := strings.Cut(s, ":")
+		specs = append(specs, SourceSpec{Type: typ, Timeout: timeout})
+	}
+	return specs
+}
+
+// sourceChain tries port sources in order and returns the ports of the
+// first one that answers in time. It implements GlueGetter and PortsGetter.
+// The sources are created on first use and again when they are reconfigured.
+type sourceChain struct {
+	mu      sync.Mutex
+	specs   []SourceSpec
+	sources []PortSource
+	cancel  context.CancelFunc // stops the keep alive of the sources
+	current string             // the source that gave the last port
+}
+
+// GetGlueTunPort returns the first port of the first healthy source.
+func (s *sourceChain) GetGlueTunPort(config Config, client HttpDoer) (int, error) {
+	return firstPort(s.GetGlueTunPorts(config, client))
+}
+
+// GetGlueTunPorts returns every port of the first healthy source.
+// If every source fails, their errors are joined.
+func (s *sourceChain) GetGlueTunPorts(config Config, client HttpDoer) ([]int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	specs := config.sources()
+	if s.sources == nil || !reflect.DeepEqual(specs, s.specs) {
+		s.build(config, specs)
+	}
+	var errs []error
+	for i, spec := range specs {
+		ports, err := sourcePorts(s.sources[i], spec.timeout(), config, client)
+		if err == nil {
+			err = checkForwardedPorts(ports)
+		}
+		if err != nil {
+			logger("source").Debug("Port source failed", "source", spec.Type, "error", err)
+			errs = append(errs, fmt.Errorf("%s: %w", spec.Type, err))
+			continue
+		}
+		if s.current != spec.Type {
+			logger("source").Info("Using port source", "source", spec.Type)
+			s.current = spec.Type
+		}
+		return ports, nil
+	}
+	s.current = ""
+	return nil, errors.Join(errs...)
+}
+
+// Source returns the name of the source that gave the last port,
+// or an empty string if none did.
+func (s *sourceChain) Source() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.current
+}
+
+// build creates the sources and starts their keep alive when running continuously.
+// s.mu must be held.
+func (s *sourceChain) build(config Config, specs []SourceSpec) {
+	if s.cancel != nil {
+		s.cancel()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
+	s.specs = specs
+	s.sources = make([]PortSource, len(specs))
+	for i, spec := range specs {
+		source := portSources[spec.Type].new(config)
+		if k, ok := source.(keepAliver); ok && config.UpdateInterval != 0 {
+			go k.keepAlive(ctx)
+		}
+		s.sources[i] = source
+	}
+}
+
+// sourcePorts gets the ports from a source, giving up after timeout.
+// Sources with a single port return a list of one.
+func sourcePorts(source PortSource, timeout time.Duration, config Config, client HttpDoer) ([]int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	type result struct {
+		ports []int
+		err   error
+	}
+	done := make(chan result, 1)
+	go func() {
+		if m, ok := source.(multiPortSource); ok {
+			ports, err := m.Ports(ctx, config, client)
+			done <- result{ports, err}
+			return
+		}
+		port, err := source.Port(ctx, config, client)
+		done <- result{[]int{port}, err}
+	}()
+	select {
+	case r := <-done:
+		return r.ports, r.err
+	case <-ctx.Done():
+		return nil, fmt.Errorf("timed out after %s", timeout)
+	}
+}
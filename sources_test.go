@@ -0,0 +1,176 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSources(t *testing.T) {
+	t.Parallel()
+
+	got := parseSources(" gluetun-api:2s, gluetun-file,,natpmp ")
+	want := []SourceSpec{
+		{Type: "gluetun-api", Timeout: "2s"},
+		{Type: "gluetun-file"},
+		{Type: "natpmp"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected sources %+v, got %+v", want, got)
+	}
+}
+
+func TestConfigSources(t *testing.T) {
+	t.Parallel()
+
+	tt := []struct {
+		name   string
+		config Config
+		want   []SourceSpec
+	}{
+		{
+			name:   "gluetun api and file",
+			config: Config{GlueTunHost: "gluetun", GlueTunPort: 8000, GlueTunPortFile: "/tmp/port"},
+			want:   []SourceSpec{{Type: "gluetun-api"}, {Type: "gluetun-file"}},
+		},
+		{
+			name:   "natpmp replaces gluetun",
+			config: Config{GlueTunHost: "gluetun", GlueTunPort: 8000, NatPmpGateway: "10.2.0.1"},
+			want:   []SourceSpec{{Type: "natpmp"}},
+		},
+		{
+			name:   "static port replaces gluetun",
+			config: Config{GlueTunHost: "gluetun", GlueTunPort: 8000, StaticPort: 51413},
+			want:   []SourceSpec{{Type: "static"}},
+		},
+		{
+			name: "config file list",
+			config: Config{
+				GlueTunHost: "gluetun", GlueTunPort: 8000,
+				SourceList: []SourceSpec{{Type: "gluetun-file", Timeout: "3s"}},
+			},
+			want: []SourceSpec{{Type: "gluetun-file", Timeout: "3s"}},
+		},
+		{
+			name: "argument overrides config file",
+			config: Config{
+				Sources:    "natpmp,gluetun-api",
+				SourceList: []SourceSpec{{Type: "gluetun-file"}},
+			},
+			want: []SourceSpec{{Type: "natpmp"}, {Type: "gluetun-api"}},
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.config.sources(); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("Expected sources %+v, got %+v", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestSourceSpecCheck(t *testing.T) {
+	t.Parallel()
+
+	config := Config{GlueTunHost: "gluetun", GlueTunPort: 8000}
+	tt := []struct {
+		spec    SourceSpec
+		wantErr string
+	}{
+		{spec: SourceSpec{Type: "gluetun-api", Timeout: "2s"}},
+		{spec: SourceSpec{Type: "vpn-magic"}, wantErr: "unknown port source"},
+		{spec: SourceSpec{Type: "gluetun-api", Timeout: "soon"}, wantErr: "invalid timeout"},
+		{spec: SourceSpec{Type: "gluetun-file"}, wantErr: "needs --gluetunportfile"},
+		{spec: SourceSpec{Type: "natpmp"}, wantErr: "needs --natpmpgateway"},
+		{spec: SourceSpec{Type: "pia"}, wantErr: "needs --piagateway"},
+	}
+	for _, tc := range tt {
+		err := tc.spec.check(config)
+		if tc.wantErr == "" && err != nil {
+			t.Errorf("Unexpected error for %+v, %s", tc.spec, err)
+		}
+		if tc.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tc.wantErr)) {
+			t.Errorf("Expected error containing %q for %+v, got %v", tc.wantErr, tc.spec, err)
+		}
+	}
+}
+
+func TestSourceChain(t *testing.T) {
+	t.Parallel()
+
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		w.Write([]byte(`{"port": 11111}`))
+	}))
+	defer slow.Close()
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"port": 11111}`))
+	}))
+	defer fast.Close()
+	portFile := filepath.Join(t.TempDir(), "forwarded_port")
+	if err := os.WriteFile(portFile, []byte(`{"port": 22222}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tt := []struct {
+		name       string
+		config     Config
+		wantPort   int
+		wantSource string
+		wantErr    bool
+	}{
+		{
+			name:       "first source wins",
+			config:     Config{GlueTunUrl: fast.URL, GlueTunPortFile: portFile, Sources: "gluetun-api,gluetun-file"},
+			wantPort:   11111,
+			wantSource: "gluetun-api",
+		},
+		{
+			name:       "order is configurable",
+			config:     Config{GlueTunUrl: fast.URL, GlueTunPortFile: portFile, Sources: "gluetun-file,gluetun-api"},
+			wantPort:   22222,
+			wantSource: "gluetun-file",
+		},
+		{
+			name:       "fail over after timeout",
+			config:     Config{GlueTunUrl: slow.URL, GlueTunPortFile: portFile, Sources: "gluetun-api:50ms,gluetun-file"},
+			wantPort:   22222,
+			wantSource: "gluetun-file",
+		},
+		{
+			name:    "all sources fail",
+			config:  Config{GlueTunUrl: slow.URL, GlueTunPortFile: "DNE", Sources: "gluetun-api:50ms,gluetun-file"},
+			wantErr: true,
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			chain := &sourceChain{}
+			port, err := chain.GetGlueTunPort(tc.config, http.DefaultClient)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("Expected error, got nil")
+				}
+				// every failure is reported
+				if !strings.Contains(err.Error(), "gluetun-api: timed out") || !strings.Contains(err.Error(), "gluetun-file:") {
+					t.Errorf("Expected errors of both sources, got %q", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if port != tc.wantPort {
+				t.Errorf("Expected port %d, got %d", tc.wantPort, port)
+			}
+			if chain.Source() != tc.wantSource {
+				t.Errorf("Expected source '%s', got '%s'", tc.wantSource, chain.Source())
+			}
+		})
+	}
+}
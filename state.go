@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// stateFileName is the name of the state file in --statedir.
+const stateFileName = "state.json"
+
+// State is what gluebit remembers across restarts, saved in --statedir.
+type State struct {
+	// Ports are the last good forwarded ports, set in at least one target.
+	Ports []int `json:"ports"`
+	// Source is the port source that forwarded Ports.
+	Source string `json:"source,omitempty"`
+	// Updated is when Ports were last set or verified in a target.
+	Updated time.Time `json:"updated"`
+	// SuppressedFlaps counts the new ports that changed again before they were
+	// stable, see --stablereads and --stabletime.
+	SuppressedFlaps int `json:"suppressed_flaps,omitempty"`
+	// Targets holds the result of the last sync of every target.
+	Targets map[string]TargetState `json:"targets,omitempty"`
+
+	// saved is the state last written without its times, and savedAt when
+	// it was written, see saveState.
+	saved   []byte
+	savedAt time.Time
+}
+
+// TargetState is the result of the last sync of a target.
+type TargetState struct {
+	// Port is the port last set or verified in the target.
+	Port int `json:"port,omitempty"`
+	// Synced is when Port was last set or verified.
+	Synced time.Time `json:"synced,omitempty"`
+	// Checked is when the target was last synced, successfully or not.
+	Checked time.Time `json:"checked"`
+	// Error is the error of the last sync, if it failed.
+	Error string `json:"error,omitempty"`
+}
+
+// stateFile returns the path of the state file, or an empty string if
+// no state is kept.
+func (c Config) stateFile() string {
+	if c.StateDir == "" {
+		return ""
+	}
+	return filepath.Join(c.StateDir, stateFileName)
+}
+
+// readState reads the state file. A missing file is an empty state.
+func readState(path string) (State, error) {
+	var state State
+	if path == "" {
+		return state, nil
+	}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return state, err
+	}
+	if err := json.Unmarshal(b, &state); err != nil {
+		return state, fmt.Errorf("cannot decode state file %s: %w", path, err)
+	}
+	return state, nil
+}
+
+// writeState writes the state file atomically.
+func writeState(path string, state State) error {
+	if path == "" {
+		return nil
+	}
+	b, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	return writeFileAtomic(path, append(b, '\n'), 0o644)
+}
+
+// writeFileAtomic writes data to a temporary file next to path and renames it
+// to path, so that readers never see a partly written file.
+func writeFileAtomic(path string, data []byte, perm fs.FileMode) error {
+	return writeFileAtomicOwner(path, data, perm, -1, -1)
+}
+
+// writeFileAtomicOwner is like writeFileAtomic, but also sets the owner and
+// group of the file unless uid or gid are -1.
+func writeFileAtomicOwner(path string, data []byte, perm fs.FileMode, uid, gid int) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return err
+	}
+	if uid != -1 || gid != -1 {
+		if err := os.Chown(tmp.Name(), uid, gid); err != nil {
+			return err
+		}
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// record updates the state with the result of syncing a target at now.
+func (s *State) record(target string, port int, err error, now time.Time) {
+	if s.Targets == nil {
+		s.Targets = make(map[string]TargetState)
+	}
+	t := s.Targets[target]
+	t.Checked = now
+	t.Error = ""
+	if err != nil {
+		t.Error = err.Error()
+	} else {
+		t.Port = port
+		t.Synced = now
+	}
+	s.Targets[target] = t
+}
+
+// saveState records the ports and source of a sync in which at least one
+// target succeeded, and writes the state file. If only the times changed since
+// the state was last written, it is written at most every stateRefresh, to
+// spare SD cards and network volumes. Failures are only logged, as the state
+// is not needed to keep the port in sync.
+func saveState(config Config, state *State, ports []int, source string, synced bool, now time.Time) {
+	if synced {
+		state.Ports = ports
+		state.Source = source
+		state.Updated = now
+	}
+	saved, err := json.Marshal(state.withoutTimes())
+	if err == nil && bytes.Equal(saved, state.saved) && now.Sub(state.savedAt) < stateRefresh {
+		return
+	}
+	if err := writeState(config.stateFile(), *state); err != nil {
+		logger("state").Warn("Failed to save state", "error", err)
+		return
+	}
+	state.saved = saved
+	state.savedAt = now
+}
+
+// stateRefresh is how often the state file is written when only the times
+// in the state changed.
+const stateRefresh = 5 * time.Minute
+
+// withoutTimes returns a copy of the state without its times.
+func (s State) withoutTimes() State {
+	s.Updated = time.Time{}
+	targets := make(map[string]TargetState, len(s.Targets))
+	for name, t := range s.Targets {
+		t.Synced = time.Time{}
+		t.Checked = time.Time{}
+		targets[name] = t
+	}
+	s.Targets = targets
+	return s
+}
+
+// printStatus implements "gluebit status".
+// It prints the saved state and returns the exit code,
+// which is not zero if there is no state or the last sync of a target failed.
+func printStatus(w io.Writer, config Config) int {
+	path := config.stateFile()
+	if path == "" {
+		fmt.Fprintln(os.Stderr, "No state is kept, set --statedir")
+		return 1
+	}
+	state, err := readState(path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if state.Updated.IsZero() && len(state.Targets) == 0 {
+		fmt.Fprintln(os.Stderr, "No port has been set yet")
+		return 1
+	}
+	code := 0
+	for _, t := range state.Targets {
+		if t.Error != "" {
+			code = 1
+		}
+	}
+	if config.StatusCmd != nil && config.StatusCmd.JSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(state)
+		return code
+	}
+	if len(state.Ports) > 0 {
+		fmt.Fprintf(w, "Port:    %s", formatPorts(state.Ports))
+		if state.Source != "" {
+			fmt.Fprintf(w, " from %s", state.Source)
+		}
+		fmt.Fprintf(w, "\nUpdated: %s\n", state.Updated.Format(time.RFC3339))
+	}
+	if state.SuppressedFlaps > 0 {
+		fmt.Fprintf(w, "Suppressed flapping ports: %d\n", state.SuppressedFlaps)
+	}
+	names := make([]string, 0, len(state.Targets))
+	for name := range state.Targets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		t := state.Targets[name]
+		if t.Error != "" {
+			fmt.Fprintf(w, "%s: failed at %s: %s\n", name, t.Checked.Format(time.RFC3339), t.Error)
+			continue
+		}
+		fmt.Fprintf(w, "%s: port %d, synced at %s\n", name, t.Port, t.Synced.Format(time.RFC3339))
+	}
+	return code
+}
+
+// formatPorts formats ports as a comma separated list.
+func formatPorts(ports []int) string {
+	s := ""
+	for i, p := range ports {
+		if i > 0 {
+			s += ", "
+		}
+		s += fmt.Sprint(p)
+	}
+	return s
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestStateFile(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	config := Config{StateDir: filepath.Join(dir, "state")}
+
+	// a missing state file is an empty state
+	state, err := readState(config.stateFile())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(state, State{}) {
+		t.Errorf("Expected empty state, got %+v", state)
+	}
+
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	state.record("qbittorrent", 51413, nil, now)
+	state.record("seedbox", 0, errors.New("connection refused"), now)
+	saveState(config, &state, []int{51413}, "gluetun-api", true, now)
+
+	got, err := readState(config.stateFile())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := State{
+		Ports:   []int{51413},
+		Source:  "gluetun-api",
+		Updated: now,
+		Targets: map[string]TargetState{
+			"qbittorrent": {Port: 51413, Synced: now, Checked: now},
+			"seedbox":     {Checked: now, Error: "connection refused"},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected state %+v, got %+v", want, got)
+	}
+
+	// a failed sync keeps the last good port
+	later := now.Add(time.Minute)
+	got.record("qbittorrent", 0, errors.New("gluetun is down"), later)
+	saveState(config, &got, nil, "", false, later)
+	got, err = readState(config.stateFile())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got.Ports, []int{51413}) || !got.Updated.Equal(now) {
+		t.Errorf("Expected last good port 51413 from %s, got %v from %s", now, got.Ports, got.Updated)
+	}
+	if q := got.Targets["qbittorrent"]; q.Port != 51413 || !q.Synced.Equal(now) || q.Error == "" {
+		t.Errorf("Expected failed sync after port 51413, got %+v", q)
+	}
+
+	// no temporary files are left behind
+	entries, err := os.ReadDir(config.StateDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("Expected only the state file, got %v", entries)
+	}
+
+	if err := os.WriteFile(config.stateFile(), []byte("{"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readState(config.stateFile()); err == nil {
+		t.Error("Expected error, got nil")
+	}
+}
+
+func TestSaveStateUnchanged(t *testing.T) {
+	t.Parallel()
+
+	config := Config{StateDir: t.TempDir()}
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	var state State
+	sync := func(port int, at time.Time) {
+		state.record("qbittorrent", port, nil, at)
+		saveState(config, &state, []int{port}, "gluetun-api", true, at)
+	}
+	updated := func() time.Time {
+		saved, err := readState(config.stateFile())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return saved.Updated
+	}
+
+	tests := []struct {
+		name string
+		port int
+		at   time.Time
+		want time.Time
+	}{
+		{name: "first sync", port: 51413, at: now, want: now},
+		{name: "only the times changed", port: 51413, at: now.Add(time.Minute), want: now},
+		{name: "port changed", port: 51414, at: now.Add(2 * time.Minute), want: now.Add(2 * time.Minute)},
+		{name: "refresh", port: 51414, at: now.Add(2*time.Minute + stateRefresh), want: now.Add(2*time.Minute + stateRefresh)},
+	}
+	for _, tt := range tests {
+		sync(tt.port, tt.at)
+		if got := updated(); !got.Equal(tt.want) {
+			t.Errorf("%s: expected saved state from %s, got %s", tt.name, tt.want, got)
+		}
+	}
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "port")
+	if err := os.WriteFile(path, []byte("old"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFileAtomic(path, []byte("new"), 0o640); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "new" {
+		t.Errorf("Expected contents 'new', got '%s'", b)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0o640 {
+		t.Errorf("Expected mode 0640, got %o", info.Mode().Perm())
+	}
+}
+
+func TestPrintStatus(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	tt := []struct {
+		name     string
+		state    *State
+		wantCode int
+		want     string
+	}{
+		{
+			name:     "no state",
+			wantCode: 1,
+		},
+		{
+			name: "synced",
+			state: &State{
+				Ports: []int{51413, 51414}, Source: "gluetun-api", Updated: now,
+				Targets: map[string]TargetState{"qbittorrent": {Port: 51413, Synced: now, Checked: now}},
+			},
+			want: "Port:    51413, 51414 from gluetun-api\nUpdated: 2026-10-18T12:00:00Z\nqbittorrent: port 51413, synced at 2026-10-18T12:00:00Z\n",
+		},
+		{
+			name: "flapping ports",
+			state: &State{
+				Ports: []int{51413}, Updated: now, SuppressedFlaps: 3,
+				Targets: map[string]TargetState{"qbittorrent": {Port: 51413, Synced: now, Checked: now}},
+			},
+			want: "Port:    51413\nUpdated: 2026-10-18T12:00:00Z\nSuppressed flapping ports: 3\nqbittorrent: port 51413, synced at 2026-10-18T12:00:00Z\n",
+		},
+		{
+			name: "failed target",
+			state: &State{
+				Ports: []int{51413}, Updated: now,
+				Targets: map[string]TargetState{"seedbox": {Checked: now, Error: "connection refused"}},
+			},
+			wantCode: 1,
+			want:     "Port:    51413\nUpdated: 2026-10-18T12:00:00Z\nseedbox: failed at 2026-10-18T12:00:00Z: connection refused\n",
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			config := Config{StateDir: t.TempDir()}
+			if tc.state != nil {
+				if err := writeState(config.stateFile(), *tc.state); err != nil {
+					t.Fatal(err)
+				}
+			}
+			var out bytes.Buffer
+			if code := printStatus(&out, config); code != tc.wantCode {
+				t.Errorf("Expected exit code %d, got %d", tc.wantCode, code)
+			}
+			if out.String() != tc.want {
+				t.Errorf("Expected output %q, got %q", tc.want, out.String())
+			}
+		})
+	}
+}
+
+func TestDebouncerKeepLastPort(t *testing.T) {
+	t.Parallel()
+
+	// the last good port of the state is kept while gluetun is down
+	d := &debouncer{glue: &mockGlueGetter{err: errors.New("gluetun is down")}, stable: []int{51413}}
+	if _, err := d.GetGlueTunPort(Config{}, http.DefaultClient); err == nil {
+		t.Error("Expected error without --keeplastport, got nil")
+	}
+	port, err := d.GetGlueTunPort(Config{KeepLastPort: true}, http.DefaultClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if port != 51413 {
+		t.Errorf("Expected port %d, got %d", 51413, port)
+	}
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// staticSource returns the fixed port of --port, for providers such as AirVPN
+// that forward the same port for good. Because the port is set on every update,
+// qbittorrent is corrected when the port is changed in its WebUI or reset.
+type staticSource struct{}
+
+// Port returns the configured port.
+func (staticSource) Port(_ context.Context, config Config, _ HttpDoer) (int, error) {
+	return config.StaticPort, nil
+}
+
+// checkStatic reports problems with the static port.
+func checkStatic(c Config) error {
+	if c.StaticPort == 0 {
+		return errors.New("needs --port")
+	}
+	if c.StaticPort < 1 || c.StaticPort > 65535 {
+		return fmt.Errorf("--port %d is not a valid port", c.StaticPort)
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import "testing"
+
+func TestCheckStatic(t *testing.T) {
+	t.Parallel()
+
+	tt := []struct {
+		port    int
+		wantErr bool
+	}{
+		{port: 51413},
+		{port: 0, wantErr: true},
+		{port: -1, wantErr: true},
+		{port: 65536, wantErr: true},
+	}
+	for _, tc := range tt {
+		if err := checkStatic(Config{StaticPort: tc.port}); (err != nil) != tc.wantErr {
+			t.Errorf("checkStatic(%d) error = %v, wantErr %v", tc.port, err, tc.wantErr)
+		}
+	}
+}
+
+func TestStaticSource(t *testing.T) {
+	t.Parallel()
+
+	// the port is enforced on every update, correcting changes made in qbittorrent
+	config := Config{StaticPort: 51413}
+	client := &mockClient{pref: Preferences{ListenPort: 51413}}
+	chain := &sourceChain{}
+	if _, _, err := setPort(config, Target{}, client, chain); err != nil {
+		t.Fatal(err)
+	}
+	client.pref.ListenPort = 6881
+	client.pref.RandomPort = true
+	if _, _, err := setPort(config, Target{}, client, chain); err != nil {
+		t.Fatal(err)
+	}
+	if client.pref.ListenPort != 51413 || client.pref.RandomPort {
+		t.Errorf("Expected port 51413 without random port, got %+v", client.pref)
+	}
+	if chain.Source() != "static" {
+		t.Errorf("Expected source 'static', got '%s'", chain.Source())
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// TemplateSpec renders a text/template file with the forwarded port,
+// for apps that only read their port from a config file.
+type TemplateSpec struct {
+	// Source is the path of the template.
+	Source string `yaml:"source" toml:"source"`
+	// Output is the path of the rendered file.
+	Output string `yaml:"output" toml:"output"`
+	// Mode is the octal permissions of Output, 0644 by default.
+	Mode string `yaml:"mode" toml:"mode"`
+	// Owner is the owner of Output as user, user:group or uid:gid, unchanged by default.
+	Owner string `yaml:"owner" toml:"owner"`
+	// Command runs after Output was written, e.g. to reload the app, like a hook.
+	Command []string          `yaml:"command" toml:"command"`
+	Env     map[string]string `yaml:"env" toml:"env"`
+	Timeout string            `yaml:"timeout" toml:"timeout"`
+}
+
+// TemplateData is passed to templates.
+type TemplateData struct {
+	// Port is the first of Ports.
+	Port  int
+	Ports []int
+	// PublicIP is the public IP of the VPN, if the gluetun api is a port source.
+	PublicIP string
+	Source   string
+}
+
+// mode returns the permissions of the output.
+func (s TemplateSpec) mode() (fs.FileMode, error) {
+	if s.Mode == "" {
+		return 0o644, nil
+	}
+	m, err := strconv.ParseUint(s.Mode, 8, 32)
+	if err != nil || m > 0o777 {
+		return 0, fmt.Errorf("mode %q is not an octal file mode such as 0644", s.Mode)
+	}
+	return fs.FileMode(m), nil
+}
+
+// owner returns the uid and gid of the output, -1 if they are not changed.
+func (s TemplateSpec) owner() (int, int, error) {
+	if s.Owner == "" {
+		return -1, -1, nil
+	}
+	name, group, hasGroup := strings.Cut(s.Owner, ":")
+	uid, err := lookupId(name, func(name string) (string, error) {
+		u, err := user.Lookup(name)
+		if err != nil {
+			return "", err
+		}
+		return u.Uid, nil
+	})
+	if err != nil {
+		return -1, -1, fmt.Errorf("owner %q: %w", s.Owner, err)
+	}
+	gid := -1
+	if hasGroup {
+		gid, err = lookupId(group, func(name string) (string, error) {
+			g, err := user.LookupGroup(name)
+			if err != nil {
+				return "", err
+			}
+			return g.Gid, nil
+		})
+		if err != nil {
+			return -1, -1, fmt.Errorf("owner %q: %w", s.Owner, err)
+		}
+	}
+	return uid, gid, nil
+}
+
+// lookupId returns the numeric id of name, looking it up if it is not a number.
+func lookupId(name string, lookup func(string) (string, error)) (int, error) {
+	if id, err := strconv.Atoi(name); err == nil {
+		return id, nil
+	}
+	id, err := lookup(name)
+	if err != nil {
+		return -1, err
+	}
+	return strconv.Atoi(id)
+}
+
+// hook returns the command of the template as a hook.
+func (s TemplateSpec) hook() HookSpec {
+	return HookSpec{Name: s.Output, Command: s.Command, Env: s.Env, Timeout: s.Timeout}
+}
+
+// parse reads and parses the template.
+func (s TemplateSpec) parse() (*template.Template, error) {
+	b, err := os.ReadFile(s.Source)
+	if err != nil {
+		return nil, err
+	}
+	return template.New(filepath.Base(s.Source)).Option("missingkey=error").Parse(string(b))
+}
+
+// check reports problems with the settings of the template.
+func (s TemplateSpec) check() error {
+	var errs []error
+	if s.Source == "" {
+		errs = append(errs, errors.New("needs a source"))
+	} else if _, err := s.parse(); err != nil {
+		errs = append(errs, err)
+	}
+	if s.Output == "" {
+		errs = append(errs, errors.New("needs an output"))
+	}
+	if _, err := s.mode(); err != nil {
+		errs = append(errs, err)
+	}
+	if _, _, err := s.owner(); err != nil {
+		errs = append(errs, err)
+	}
+	if len(s.Command) > 0 {
+		if err := s.hook().check(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// render renders the template with data.
+func (s TemplateSpec) render(data TemplateData) ([]byte, error) {
+	tmpl, err := s.parse()
+	if err != nil {
+		return nil, err
+	}
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, data); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// write renders the template with data and writes it to its output, unless
+// the output already has that content. It reports whether the output changed.
+func (s TemplateSpec) write(data TemplateData) (bool, error) {
+	b, err := s.render(data)
+	if err != nil {
+		return false, err
+	}
+	if current, err := os.ReadFile(s.Output); err == nil && bytes.Equal(current, b) {
+		return false, nil
+	}
+	mode, err := s.mode()
+	if err != nil {
+		return false, err
+	}
+	uid, gid, err := s.owner()
+	if err != nil {
+		return false, err
+	}
+	return true, writeFileAtomicOwner(s.Output, b, mode, uid, gid)
+}
+
+// templateRenderer renders the templates of the config whenever the
+// forwarded ports or the public IP of the VPN change.
+type templateRenderer struct {
+	hooks    *hookRunner             // runs the commands of the templates
+	gluetun  gluetunClients          // reads the public IP
+	publicIP string                  // last public IP, kept while it cannot be read
+	rendered map[string]TemplateData // data last rendered to every output
+	dryRun   map[string]TemplateData // data last logged with --dry-run for every output
+}
+
+// render renders every template whose data changed since it was last rendered.
+// Templates that fail are rendered again on the next update.
+// With --dry-run, the templates are only logged, once per change of their data.
+// The commands of the templates run in the background, like hooks.
+func (r *templateRenderer) render(config Config, ports []int, source string, now time.Time) {
+	templates := config.Templates
+	if len(templates) == 0 || checkForwardedPorts(ports) != nil {
+		return
+	}
+	for _, port := range ports {
+		if config.allowedPorts().check(port) != nil {
+			return
+		}
+	}
+	if r.rendered == nil {
+		r.rendered = make(map[string]TemplateData)
+		r.dryRun = make(map[string]TemplateData)
+	}
+	r.updatePublicIP(config)
+	data := TemplateData{Port: ports[0], Ports: ports, PublicIP: r.publicIP, Source: source}
+	for _, tmpl := range templates {
+		last, ok := r.rendered[tmpl.Output]
+		if ok && sameTemplateData(last, data) {
+			continue
+		}
+		if config.DryRun {
+			if planned, ok := r.dryRun[tmpl.Output]; !ok || !sameTemplateData(planned, data) {
+				logger("template").Info("Dry run, not rendering template", "source", tmpl.Source, "output", tmpl.Output, "port", data.Port)
+				r.dryRun[tmpl.Output] = data
+			}
+			continue
+		}
+		changed, err := tmpl.write(data)
+		if err != nil {
+			logger("template").Warn("Failed to render template", "source", tmpl.Source, "output", tmpl.Output, "error", err)
+			continue
+		}
+		r.rendered[tmpl.Output] = data
+		if !changed {
+			continue
+		}
+		logger("template").Info("Rendered template", "source", tmpl.Source, "output", tmpl.Output, "port", data.Port)
+		if len(tmpl.Command) > 0 {
+			change := newPortChange(last.Ports, ports, source, nil, now)
+			r.hooks.enqueue("templates "+tmpl.Output, config, tmpl.hook(), change)
+		}
+	}
+}
+
+// sameTemplateData reports whether the ports and public IP of a and b are the same.
+func sameTemplateData(a, b TemplateData) bool {
+	return equalPorts(a.Ports, b.Ports) && a.PublicIP == b.PublicIP
+}
+
+// updatePublicIP reads the public IP of the VPN from gluetun, if its api is
+// a port source. On errors, the last public IP is kept.
+func (r *templateRenderer) updatePublicIP(config Config) {
+	usesApi := false
+	for _, spec := range config.sources() {
+		usesApi = usesApi || spec.Type == "gluetun-api"
+	}
+	if !usesApi {
+		return
+	}
+	client, err := r.gluetun.get(config, http.DefaultClient)
+	if err != nil {
+		logger("template").Warn("Failed to read the public IP", "error", err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), portSources["gluetun-api"].timeout)
+	defer cancel()
+	var body struct {
+		PublicIP string `json:"public_ip"`
+	}
+	if err := gluetunGet(ctx, client, config.gluetunUrl(), "v1/publicip/ip", &body); err != nil {
+		logger("template").Warn("Failed to read the public IP", "error", err)
+		return
+	}
+	r.publicIP = body.PublicIP
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeTemplate(t *testing.T, text string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "app.conf.tmpl")
+	if err := os.WriteFile(path, []byte(text), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestTemplateRenderer(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	out := filepath.Join(dir, "app.conf")
+	runs := filepath.Join(dir, "runs")
+	config := Config{
+		HookTimeout: 5,
+		Templates: []TemplateSpec{{
+			Source:  writeTemplate(t, "port={{.Port}}\nports={{range .Ports}}{{.}} {{end}}\n"),
+			Output:  out,
+			Mode:    "0600",
+			Command: []string{"sh", "-c", `echo "$GLUEBIT_OLD_PORT $GLUEBIT_NEW_PORT" >> "$RUNS"`},
+			Env:     map[string]string{"RUNS": runs},
+		}},
+	}
+	r := templateRenderer{hooks: &hookRunner{}}
+	r.render(config, []int{51413, 51414}, "", time.Now())
+	b, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "port=51413\nports=51413 51414 \n"; string(b) != want {
+		t.Errorf("Expected %q, got %q", want, b)
+	}
+	info, err := os.Stat(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0o600 {
+		t.Errorf("Expected mode 0600, got %o", info.Mode().Perm())
+	}
+
+	// the same ports, no port and invalid ports render nothing
+	r.render(config, []int{51413, 51414}, "", time.Now())
+	r.render(config, nil, "", time.Now())
+	r.render(config, []int{80}, "", time.Now())
+	r.render(config, []int{52000}, "", time.Now())
+	// the same content is not written again, and runs no command
+	r.rendered = nil
+	r.render(config, []int{52000}, "", time.Now())
+	r.hooks.wait()
+
+	b, err = os.ReadFile(runs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "0 51413\n51413 52000\n"; string(b) != want {
+		t.Errorf("Expected the command to run with %q, got %q", want, b)
+	}
+}
+
+func TestTemplateRendererPublicIP(t *testing.T) {
+	t.Parallel()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/publicip/ip" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(`{"public_ip":"203.0.113.7"}`))
+	}))
+	defer server.Close()
+	u, _ := url.Parse(server.URL)
+	port, _ := strconv.Atoi(u.Port())
+
+	out := filepath.Join(t.TempDir(), "app.conf")
+	config := Config{
+		GlueTunHost: u.Hostname(),
+		GlueTunPort: port,
+		Templates:   []TemplateSpec{{Source: writeTemplate(t, "{{.PublicIP}}:{{.Port}}"), Output: out}},
+	}
+	r := templateRenderer{hooks: &hookRunner{}}
+	r.render(config, []int{51413}, "gluetun-api", time.Now())
+	b, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "203.0.113.7:51413"; string(b) != want {
+		t.Errorf("Expected %q, got %q", want, b)
+	}
+}
+
+func TestTemplateRendererDryRun(t *testing.T) {
+	t.Parallel()
+
+	out := filepath.Join(t.TempDir(), "app.conf")
+	config := Config{DryRun: true, Templates: []TemplateSpec{{Source: writeTemplate(t, "{{.Port}}"), Output: out}}}
+	r := templateRenderer{hooks: &hookRunner{}}
+	r.render(config, []int{51413}, "", time.Now())
+	r.render(config, []int{51413}, "", time.Now())
+	if _, err := os.Stat(out); !os.IsNotExist(err) {
+		t.Errorf("Expected no output in a dry run, got %v", err)
+	}
+	if got := r.dryRun[out].Port; got != 51413 {
+		t.Errorf("Expected the dry run of port 51413 to be remembered, got %d", got)
+	}
+	// the dry run does not count as rendered
+	config.DryRun = false
+	r.render(config, []int{51413}, "", time.Now())
+	if b, err := os.ReadFile(out); err != nil || string(b) != "51413" {
+		t.Errorf("Expected the template to be rendered after the dry run, got %q, %v", b, err)
+	}
+}
+
+func TestTemplateSpecCheck(t *testing.T) {
+	t.Parallel()
+
+	source := writeTemplate(t, "{{.Port}}")
+	tests := []struct {
+		name    string
+		spec    TemplateSpec
+		wantErr string
+	}{
+		{name: "valid", spec: TemplateSpec{Source: source, Output: "out", Mode: "0640", Owner: "0:0"}},
+		{name: "no source", spec: TemplateSpec{Output: "out"}, wantErr: "needs a source"},
+		{name: "missing source", spec: TemplateSpec{Source: source + ".missing", Output: "out"}, wantErr: "no such file"},
+		{name: "bad template", spec: TemplateSpec{Source: writeTemplate(t, "{{.Port"), Output: "out"}, wantErr: "unclosed action"},
+		{name: "no output", spec: TemplateSpec{Source: source}, wantErr: "needs an output"},
+		{name: "bad mode", spec: TemplateSpec{Source: source, Output: "out", Mode: "rw-r--r--"}, wantErr: "not an octal file mode"},
+		{name: "mode too large", spec: TemplateSpec{Source: source, Output: "out", Mode: "1777"}, wantErr: "not an octal file mode"},
+		{name: "unknown owner", spec: TemplateSpec{Source: source, Output: "out", Owner: "no-such-user-gluebit"}, wantErr: "owner"},
+		{name: "bad timeout", spec: TemplateSpec{Source: source, Output: "out", Command: []string{"true"}, Timeout: "soon"}, wantErr: "not a positive duration"},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			err := tt.spec.check()
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("Expected no error, got %v", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Errorf("Expected an error containing %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
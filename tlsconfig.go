@@ -0,0 +1,95 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// tlsVersions maps the accepted values of min_version to TLS versions.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// TLSOptions configures how a server is verified over https
+// and how gluebit authenticates to it with a client certificate.
+type TLSOptions struct {
+	CAFiles    []string `yaml:"ca_files" toml:"ca_files"`
+	CertFile   string   `yaml:"cert_file" toml:"cert_file"`
+	KeyFile    string   `yaml:"key_file" toml:"key_file"`
+	MinVersion string   `yaml:"min_version" toml:"min_version"`
+	Insecure   bool     `yaml:"insecure_skip_verify" toml:"insecure_skip_verify"`
+}
+
+// isZero reports whether no TLS option is set.
+func (o TLSOptions) isZero() bool {
+	return len(o.CAFiles) == 0 && o.CertFile == "" && o.KeyFile == "" && o.MinVersion == "" && !o.Insecure
+}
+
+// tlsConfig builds a tls.Config from the options.
+// Extra CA files are trusted in addition to the system roots.
+// It returns nil if no option is set, so the defaults are used.
+func (o TLSOptions) tlsConfig() (*tls.Config, error) {
+	if o.isZero() {
+		return nil, nil
+	}
+	config := &tls.Config{
+		InsecureSkipVerify: o.Insecure,
+	}
+	var errs []error
+	if o.MinVersion != "" {
+		version, ok := tlsVersions[o.MinVersion]
+		if !ok {
+			errs = append(errs, fmt.Errorf("unknown TLS version %q, use 1.0, 1.1, 1.2 or 1.3", o.MinVersion))
+		}
+		config.MinVersion = version
+	}
+	if len(o.CAFiles) > 0 {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		for _, file := range o.CAFiles {
+			pem, err := os.ReadFile(file)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("cannot read CA file: %w", err))
+				continue
+			}
+			if !pool.AppendCertsFromPEM(pem) {
+				errs = append(errs, fmt.Errorf("no certificates found in CA file %s", file))
+			}
+		}
+		config.RootCAs = pool
+	}
+	switch {
+	case o.CertFile != "" && o.KeyFile != "":
+		cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("cannot load client certificate: %w", err))
+		}
+		config.Certificates = []tls.Certificate{cert}
+	case o.CertFile != "" || o.KeyFile != "":
+		errs = append(errs, errors.New("client certificate needs both a cert file and a key file"))
+	}
+	return config, errors.Join(errs...)
+}
+
+// newHttpClient returns an http.Client that uses the TLS options.
+func newHttpClient(o TLSOptions) (*http.Client, error) {
+	config, err := o.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	if config == nil {
+		return &http.Client{}, nil
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = config
+	return &http.Client{Transport: transport}, nil
+}
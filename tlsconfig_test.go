@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writePEM writes a single PEM block to a new file in dir and returns its path.
+func writePEM(t *testing.T, dir, name, typ string, der []byte) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// writeClientCert creates a self-signed client certificate and returns it
+// along with the paths of its cert and key files.
+func writeClientCert(t *testing.T, dir string) (*x509.Certificate, string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "gluebit"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, writePEM(t, dir, "client.crt", "CERTIFICATE", der), writePEM(t, dir, "client.key", "EC PRIVATE KEY", keyDer)
+}
+
+func TestNewHttpClient(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+	caFile := writePEM(t, dir, "ca.crt", "CERTIFICATE", ts.Certificate().Raw)
+
+	// server that requires a client certificate
+	clientCert, certFile, keyFile := writeClientCert(t, dir)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCert)
+	mtls := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	mtls.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	mtls.StartTLS()
+	defer mtls.Close()
+	mtlsCAFile := writePEM(t, dir, "mtls-ca.crt", "CERTIFICATE", mtls.Certificate().Raw)
+
+	// server that only speaks TLS 1.2
+	tls12 := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	tls12.TLS = &tls.Config{MaxVersion: tls.VersionTLS12}
+	tls12.StartTLS()
+	defer tls12.Close()
+
+	tt := []struct {
+		name       string
+		url        string
+		options    TLSOptions
+		hasErr     bool
+		requestErr bool
+	}{
+		{name: "default options", url: ts.URL, requestErr: true},
+		{name: "extra CA", url: ts.URL, options: TLSOptions{CAFiles: []string{caFile}}},
+		{name: "insecure", url: ts.URL, options: TLSOptions{Insecure: true}},
+		{name: "client cert", url: mtls.URL, options: TLSOptions{CAFiles: []string{mtlsCAFile}, CertFile: certFile, KeyFile: keyFile}},
+		{name: "missing client cert", url: mtls.URL, options: TLSOptions{CAFiles: []string{mtlsCAFile}}, requestErr: true},
+		{name: "min version too high", url: tls12.URL, options: TLSOptions{Insecure: true, MinVersion: "1.3"}, requestErr: true},
+		{name: "min version ok", url: tls12.URL, options: TLSOptions{Insecure: true, MinVersion: "1.2"}},
+		{name: "unknown version", options: TLSOptions{MinVersion: "2.0"}, hasErr: true},
+		{name: "cert without key", options: TLSOptions{CertFile: certFile}, hasErr: true},
+		{name: "missing CA file", options: TLSOptions{CAFiles: []string{filepath.Join(dir, "DNE")}}, hasErr: true},
+		{name: "CA file without certificates", options: TLSOptions{CAFiles: []string{keyFile}}, hasErr: true},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			client, err := newHttpClient(tc.options)
+			if tc.hasErr && err == nil {
+				t.Fatal("Expected error, got nil")
+			}
+			if !tc.hasErr && err != nil {
+				t.Fatal(err)
+			}
+			if tc.hasErr {
+				return
+			}
+			resp, err := client.Get(tc.url)
+			if err == nil {
+				resp.Body.Close()
+			}
+			if tc.requestErr && err == nil {
+				t.Error("Expected request error, got nil")
+			}
+			if !tc.requestErr && err != nil {
+				t.Errorf("Unexpected request error, %s", err)
+			}
+		})
+	}
+}
+
+func TestTLSClients(t *testing.T) {
+	t.Parallel()
+
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/openvpn/portforwarded":
+			w.Write([]byte(`{"port": 12345}`))
+		case "/api/v2/auth/login":
+			w.Write([]byte(ResponseBodyOK))
+		default:
+			t.Errorf("unexpected request path: %s", r.URL.Path)
+		}
+	}))
+	defer ts.Close()
+	caFile := writePEM(t, t.TempDir(), "ca.crt", "CERTIFICATE", ts.Certificate().Raw)
+
+	// gluetun over https gets its own client with its own TLS options,
+	// instead of the client passed in for qbittorrent
+	config := Config{GlueTunUrl: ts.URL, GlueTunCAFile: caFile}
+	port, err := (&gluetunApiSource{}).Port(context.Background(), config, &mockDoer{body: `{"port": 1}`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if port != 12345 {
+		t.Errorf("Expected port %d, got %d", 12345, port)
+	}
+
+	httpClient, err := newHttpClient(TLSOptions{CAFiles: []string{caFile}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewHttpClient(httpClient, ts.URL, "user", "pass"); err != nil {
+		t.Errorf("Unexpected error, %s", err)
+	}
+}
+
+func TestGluetunClientsReuse(t *testing.T) {
+	t.Parallel()
+
+	var clients gluetunClients
+	shared := &mockDoer{}
+	plain := Config{GlueTunUrl: "http://gluetun:8000"}
+	if c, err := clients.get(plain, shared); err != nil || c != HttpDoer(shared) {
+		t.Errorf("Expected the shared client for plain http, got %v, %v", c, err)
+	}
+	config := Config{GlueTunUrl: "https://gluetun:8000"}
+	first, err := clients.get(config, shared)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second, _ := clients.get(config, shared); second != first {
+		t.Error("Expected the gluetun client to be reused")
+	}
+	config.GlueTunTLS = TLSOptions{Insecure: true}
+	if third, _ := clients.get(config, shared); third == first {
+		t.Error("Expected a new gluetun client after the TLS options changed")
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// PortRule translates the forwarded port into the port a target listens on,
+// e.g. when a DNAT rule redirects the forwarded port to a fixed internal port.
+// At most one of its fields may be set; the zero rule keeps the forwarded port.
+type PortRule struct {
+	// Offset is added to the forwarded port.
+	Offset int `yaml:"offset" toml:"offset"`
+	// Port is a fixed port to listen on, whatever port is forwarded.
+	Port int `yaml:"port" toml:"port"`
+	// Table maps forwarded ports to listen ports. Unlisted ports are an error.
+	Table map[string]int `yaml:"table" toml:"table"`
+}
+
+// String describes the rule, for logs and config diffs.
+func (r PortRule) String() string {
+	switch {
+	case r.Offset != 0:
+		return fmt.Sprintf("offset %+d", r.Offset)
+	case r.Port != 0:
+		return fmt.Sprintf("port %d", r.Port)
+	case len(r.Table) > 0:
+		pairs := make([]string, 0, len(r.Table))
+		for from, to := range r.Table {
+			pairs = append(pairs, fmt.Sprintf("%s:%d", from, to))
+		}
+		sort.Strings(pairs)
+		return "table " + strings.Join(pairs, ",")
+	default:
+		return "identity"
+	}
+}
+
+// check reports problems with the rule. Fixed ports must be in the allowed range.
+func (r PortRule) check(allowed portRange) error {
+	set := 0
+	for _, isSet := range []bool{r.Offset != 0, r.Port != 0, len(r.Table) > 0} {
+		if isSet {
+			set++
+		}
+	}
+	var errs []error
+	if set > 1 {
+		errs = append(errs, errors.New("only one of offset, port and table may be set"))
+	}
+	if r.Port != 0 {
+		if err := allowed.check(r.Port); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for from, to := range r.Table {
+		if _, err := strconv.Atoi(from); err != nil {
+			errs = append(errs, fmt.Errorf("table key %q is not a port", from))
+		}
+		if err := allowed.check(to); err != nil {
+			errs = append(errs, fmt.Errorf("table entry %s: %w", from, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// apply translates the forwarded port.
+// The caller checks that the result is in the allowed range.
+func (r PortRule) apply(port int) (int, error) {
+	switch {
+	case r.Offset != 0:
+		return port + r.Offset, nil
+	case r.Port != 0:
+		return r.Port, nil
+	case len(r.Table) > 0:
+		to, ok := r.Table[strconv.Itoa(port)]
+		if !ok {
+			return 0, fmt.Errorf("forwarded port %d is not in the translation table", port)
+		}
+		return to, nil
+	}
+	return port, nil
+}
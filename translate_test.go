@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestPortRuleApply(t *testing.T) {
+	t.Parallel()
+
+	tt := []struct {
+		name     string
+		rule     PortRule
+		port     int
+		expected int
+		wantErr  string
+	}{
+		{name: "identity", port: 51413, expected: 51413},
+		{name: "offset", rule: PortRule{Offset: -100}, port: 51413, expected: 51313},
+		{name: "fixed port", rule: PortRule{Port: 6881}, port: 51413, expected: 6881},
+		{name: "table", rule: PortRule{Table: map[string]int{"51413": 6881, "51414": 6882}}, port: 51414, expected: 6882},
+		{name: "not in table", rule: PortRule{Table: map[string]int{"51413": 6881}}, port: 51414, wantErr: "not in the translation table"},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			port, err := tc.rule.apply(tc.port)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("Expected error containing %q, got %v", tc.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if port != tc.expected {
+				t.Errorf("Expected port %d, got %d", tc.expected, port)
+			}
+		})
+	}
+}
+
+func TestPortRuleCheck(t *testing.T) {
+	t.Parallel()
+
+	tt := []struct {
+		name    string
+		rule    PortRule
+		wantErr string
+	}{
+		{name: "identity"},
+		{name: "offset", rule: PortRule{Offset: 10}},
+		{name: "two rules", rule: PortRule{Offset: 10, Port: 6881}, wantErr: "only one of offset, port and table may be set"},
+		{name: "privileged port", rule: PortRule{Port: 443}, wantErr: "invalid port 443: not between"},
+		{name: "bad table key", rule: PortRule{Table: map[string]int{"any": 6881}}, wantErr: `table key "any" is not a port`},
+		{name: "bad table value", rule: PortRule{Table: map[string]int{"51413": 70000}}, wantErr: "table entry 51413: invalid port 70000"},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.rule.check(Config{}.allowedPorts())
+			if tc.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("Expected error containing %q, got %v", tc.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestQbitTranslate(t *testing.T) {
+	t.Parallel()
+
+	file := PortRule{Table: map[string]int{"51413": 6881}}
+	if rule := (Config{QbitTranslate: file}).qbitTranslate(); rule.String() != "table 51413:6881" {
+		t.Errorf("Expected the rule of the config file, got %s", rule)
+	}
+	// arguments replace the rule of the config file
+	if rule := (Config{QbitTranslate: file, QbitListenPort: 6881}).qbitTranslate(); rule.String() != "port 6881" {
+		t.Errorf("Expected the rule of the arguments, got %s", rule)
+	}
+}
+
+func TestSetPortTranslated(t *testing.T) {
+	t.Parallel()
+
+	client := &mockClient{pref: Preferences{ListenPort: 1234}}
+	target := Target{Name: "qbittorrent", Translate: PortRule{Port: 6881}}
+	if _, _, err := setPort(Config{}, target, client, &mockGlueGetter{port: 51413}); err != nil {
+		t.Fatal(err)
+	}
+	if client.pref.ListenPort != 6881 {
+		t.Errorf("Expected port %d, got %d", 6881, client.pref.ListenPort)
+	}
+	// a translation to a privileged port leaves qbittorrent alone
+	target.Translate = PortRule{Offset: -51000}
+	_, _, err := setPort(Config{}, target, client, &mockGlueGetter{port: 51413})
+	if !errors.Is(err, ErrInvalidPort) || !strings.Contains(err.Error(), "invalid port 413: not between 1024 and 65535") {
+		t.Errorf("Expected invalid port 413, got %v", err)
+	}
+	if client.pref.ListenPort != 6881 {
+		t.Errorf("Expected port %d, got %d", 6881, client.pref.ListenPort)
+	}
+}
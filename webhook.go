@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"text/template"
+)
+
+// webhook posts events as JSON, or as the body rendered from its template.
+type webhook struct {
+	spec   NotifierSpec
+	client HttpDoer
+}
+
+func newWebhook(spec NotifierSpec) Notifier {
+	return webhook{spec: spec, client: http.DefaultClient}
+}
+
+// checkWebhook reports problems with the settings of a webhook.
+func checkWebhook(spec NotifierSpec) error {
+	var errs []error
+	if err := checkNotifyUrl(spec); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := parseBodyTemplate(spec.Body); err != nil {
+		errs = append(errs, fmt.Errorf("body: %w", err))
+	}
+	return errors.Join(errs...)
+}
+
+// bodyFuncs are the functions available in body templates.
+// json encodes a value as JSON, e.g. to quote a message inside a JSON body.
+var bodyFuncs = template.FuncMap{
+	"json": func(v any) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+// parseBodyTemplate parses the template of a request body, nil if body is empty.
+func parseBodyTemplate(body string) (*template.Template, error) {
+	if body == "" {
+		return nil, nil
+	}
+	return template.New("body").Funcs(bodyFuncs).Option("missingkey=error").Parse(body)
+}
+
+func (w webhook) Notify(ctx context.Context, event Event) error {
+	body, err := w.body(event)
+	if err != nil {
+		return err
+	}
+	req, err := newNotifyRequest(ctx, w.spec, w.spec.URL, "application/json", body)
+	if err != nil {
+		return err
+	}
+	return postNotification(w.client, req)
+}
+
+// body renders the request body of event.
+func (w webhook) body(event Event) ([]byte, error) {
+	tmpl, err := parseBodyTemplate(w.spec.Body)
+	if err != nil {
+		return nil, err
+	}
+	if tmpl == nil {
+		return json.Marshal(event)
+	}
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, event); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// postNotification sends req and returns an error if the response is not 2xx.
+// Errors only name the host, as webhook urls often hold a token.
+func postNotification(client HttpDoer, req *http.Request) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			return fmt.Errorf("%s %s: %w", urlErr.Op, req.URL.Host, urlErr.Err)
+		}
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s answered %s: %s", req.URL.Host, resp.Status, strings.TrimSpace(string(b)))
+	}
+	io.Copy(io.Discard, resp.Body)
+	return nil
+}